@@ -1,44 +1,141 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
 
 	"github.com/dunkbing/tinyimg/tinyimg/config"
 	"github.com/dunkbing/tinyimg/tinyimg/handlers"
+	"github.com/dunkbing/tinyimg/tinyimg/janitor"
+	"github.com/dunkbing/tinyimg/tinyimg/metrics"
+	"github.com/dunkbing/tinyimg/tinyimg/storage"
+	"github.com/dunkbing/tinyimg/tinyimg/tracing"
+	"github.com/dunkbing/tinyimg/tinyimg/utils"
 )
 
+// enableCors lets the allowed origins call the API from a browser and
+// answers their preflight requests, which tus clients send before every
+// PATCH, HEAD and DELETE.
 func enableCors(next http.Handler) http.Handler {
-	allowedOriginsMap := map[string]bool{}
-	for _, v := range config.AllowedOrigins {
-		allowedOriginsMap[v] = true
-	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
 		origin := r.Header.Get("Origin")
-		if allowedOriginsMap[origin] {
+		allowed := origin != "" && slices.Contains(config.GetConfig().App.AllowedOrigins, origin)
+		if allowed {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, HEAD, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers",
+					"Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, Content-Type")
+				w.Header().Set("Access-Control-Max-Age", "86400")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
 func main() {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	printConfig := flags.Bool("print-config", false, "print the configuration and exit")
+	c, err := config.Load(flags, os.Args[1:])
+	if err != nil {
+		log.Fatal("Invalid configuration:\n", err)
+	}
+	if *printConfig {
+		if err := c.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	utils.SetToolPaths(c.App.Tools)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go config.Watch(ctx, 5*time.Second, func(c *config.Config) {
+		utils.SetToolPaths(c.App.Tools)
+	})
+
+	shutdownTracing, err := tracing.Setup(ctx, c.App.TraceOpt)
+	if err != nil {
+		log.Fatal("Tracing failed to start:", err)
+	}
+
 	mux := http.NewServeMux()
-	handler := handlers.New()
-	mux.Handle("/ping", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler, err := handlers.New()
+	if err != nil {
+		log.Fatal("Failed to start: ", err)
+	}
+	j := janitor.New(c.App.JanitorOpt)
+	if c.App.StorageOpt.Backend == "s3" {
+		// the outputs are in the bucket, the output directory only holds
+		// them while they are uploaded and the leftovers of failed uploads
+		j.SetStore(c.App.StorageOpt.Dir, storage.JanitorStore(handler.Storage()))
+	}
+	j.Start()
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, tracing.Handler(pattern, metrics.Instrument(pattern, h)))
+	}
+	handle("/ping", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = fmt.Fprint(w, "pong")
-	}))
-	mux.HandleFunc("POST /upload", handler.Upload)
-	mux.HandleFunc("POST /download-all", handler.DownloadAll)
-	mux.HandleFunc("/image", handler.ServeImg)
-	mux.HandleFunc("/video", handler.ServeVideo)
+	})
+	handle("POST /upload", handler.Upload)
+	handle("POST /download-all", handler.DownloadAll)
+	handle("GET /download-all/{token}", handler.DownloadBatch)
+	handle("POST /jobs", handler.CreateJob)
+	handle("GET /jobs/{id}", handler.GetJob)
+	handle("DELETE /jobs/{id}", handler.CancelJob)
+	handle("GET /stats", handler.Stats)
+	handle("GET /presets", handler.Presets)
+	handle("OPTIONS /files", handler.TusOptions)
+	handle("POST /files", handler.TusCreate)
+	handle("HEAD /files/{id}", handler.TusHead)
+	handle("PATCH /files/{id}", handler.TusPatch)
+	handle("DELETE /files/{id}", handler.TusDelete)
+	handle("/image", handler.ServeImg)
+	handle("/video", handler.ServeVideo)
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.Handle("GET /debug/vars", expvar.Handler())
 	fs := http.FileServer(http.Dir("./output"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 
-	log.Println("Server started on port 8080")
-	err := http.ListenAndServe(":8080", enableCors(handlers.Limit(mux)))
+	limited, err := handlers.Limit(mux)
 	if err != nil {
-		log.Fatal("Server failed to start:", err)
+		log.Fatal("Failed to start: ", err)
+	}
+	srv := &http.Server{Addr: c.App.Listen, Handler: handlers.ClientIP(enableCors(limited))}
+	go func() {
+		log.Println("Server started on", c.App.Listen)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Server failed to start:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Server shutdown failed:", err)
+	}
+	if err := handler.FlushStats(shutdownCtx); err != nil {
+		log.Println("Flushing stats failed:", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Println("Flushing traces failed:", err)
 	}
 }
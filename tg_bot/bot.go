@@ -21,13 +21,16 @@ type handler struct {
 	redis  *redis.Client
 }
 
-func New() *handler {
+func New() (*handler, error) {
 	c := config.GetConfig()
-	r := cache.GetRedisClient()
+	r, err := cache.GetRedisClient()
+	if err != nil {
+		return nil, err
+	}
 	return &handler{
 		config: c,
 		redis:  r,
-	}
+	}, nil
 }
 
 const (
@@ -48,7 +51,7 @@ func (h *handler) Start() {
 	opts := []bot.Option{
 		bot.WithDefaultHandler(h.helpHandler),
 	}
-	botToken := config.TgBotToken
+	botToken := h.config.App.TgBotToken
 
 	b, err := bot.New(botToken, opts...)
 	if err != nil {
@@ -139,7 +142,7 @@ func (h *handler) processJob(b *bot.Bot, jobChan <-chan Job) {
 
 		_, err = b.SendMessage(ctx, &bot.SendMessageParams{
 			ChatID: job.chatID,
-			Text:   fmt.Sprintf("%s/video?f=%s", config.HostUrl, filename),
+			Text:   fmt.Sprintf("%s/video?f=%s", h.config.App.HostUrl, filename),
 		})
 
 		if err != nil {
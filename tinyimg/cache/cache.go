@@ -1,47 +1,218 @@
 package cache
 
 import (
+	"container/list"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Cache is a simple in-memory cache with generic key and value types.
+// Options represent the limits of a Cache. The zero value is an unbounded
+// cache whose entries never expire.
+type Options[K comparable, V any] struct {
+	// TTL is how long an entry lives after it was set. Zero means forever.
+	TTL time.Duration
+	// MaxEntries is the number of entries kept before the least recently
+	// used ones are evicted. Zero means no limit.
+	MaxEntries int
+	// MaxCost is the total cost of the entries kept before the least
+	// recently used ones are evicted. It needs Cost. Zero means no limit.
+	MaxCost int64
+	// Cost returns the cost of an entry, usually its size in bytes.
+	Cost func(key K, value V) int64
+	// Loader computes the value of a missing key for GetOrLoad.
+	Loader func(key K) (V, error)
+}
+
+// Stats are the counters of a Cache.
+type Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Cost      int64 `json:"cost"`
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	cost    int64
+	expires time.Time
+}
+
+// Cache is an in-memory cache with generic key and value types. Entries are
+// kept in least recently used order and evicted when they expire or when
+// the cache grows past its limits.
 type Cache[K comparable, V any] struct {
-	mu   sync.RWMutex
-	data map[K]V
+	opt Options[K, V]
+
+	mu    sync.Mutex
+	data  map[K]*list.Element
+	order *list.List // front is the most recently used
+	cost  int64
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
 }
 
-// NewCache creates a new Cache with generic key and value types.
+// NewCache creates a new unbounded Cache with generic key and value types.
 func NewCache[K comparable, V any]() *Cache[K, V] {
+	return New(Options[K, V]{})
+}
+
+// New creates a new Cache with the given limits.
+func New[K comparable, V any](o Options[K, V]) *Cache[K, V] {
 	return &Cache[K, V]{
-		data: make(map[K]V),
+		opt:   o,
+		data:  make(map[K]*list.Element),
+		order: list.New(),
 	}
 }
 
-// Set sets a value in the cache.
+// Set sets a value in the cache, evicting the least recently used entries
+// if the cache is over its limits.
 func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.opt.TTL)
+}
+
+// SetWithTTL sets a value in the cache that expires after ttl instead of
+// the cache's TTL. Zero means it never expires.
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	e := &entry[K, V]{key: key, value: value}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	if c.opt.Cost != nil {
+		e.cost = c.opt.Cost(key, value)
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.data[key] = value
+	if el, ok := c.data[key]; ok {
+		c.remove(el)
+	}
+	c.data[key] = c.order.PushFront(e)
+	c.cost += e.cost
+	c.evict()
 }
 
 // Get gets a value from the cache.
 func (c *Cache[K, V]) Get(key K) (V, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	value, ok := c.data[key]
-	return value, ok
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.data[key]
+	if ok && c.expired(el.Value.(*entry[K, V])) {
+		c.remove(el)
+		c.evictions.Add(1)
+		ok = false
+	}
+	if !ok {
+		c.misses.Add(1)
+		var zero V
+		return zero, false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(el)
+	return el.Value.(*entry[K, V]).value, true
+}
+
+// GetOrLoad gets a value from the cache, or computes it with the cache's
+// Loader and sets it when it is missing. Errors of the Loader are returned
+// and not cached.
+func (c *Cache[K, V]) GetOrLoad(key K) (V, error) {
+	if value, ok := c.Get(key); ok || c.opt.Loader == nil {
+		return value, nil
+	}
+	value, err := c.opt.Loader(key)
+	if err != nil {
+		return value, err
+	}
+	c.Set(key, value)
+	return value, nil
 }
 
 // Delete deletes a value from the cache.
 func (c *Cache[K, V]) Delete(key K) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	delete(c.data, key)
+	if el, ok := c.data[key]; ok {
+		c.remove(el)
+	}
 }
 
 // Clear clears the cache.
 func (c *Cache[K, V]) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.data = make(map[K]V)
+	c.data = make(map[K]*list.Element)
+	c.order.Init()
+	c.cost = 0
+}
+
+// Prune removes the expired entries and returns how many there were.
+// Expired entries are otherwise only removed when they are read or evicted.
+func (c *Cache[K, V]) Prune() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if c.expired(el.Value.(*entry[K, V])) {
+			c.remove(el)
+			n++
+		}
+		el = prev
+	}
+	c.evictions.Add(int64(n))
+	return n
+}
+
+// Len returns the number of entries in the cache, including expired ones
+// that were not evicted yet.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.data)
+}
+
+// Stats returns the counters of the cache.
+func (c *Cache[K, V]) Stats() Stats {
+	c.mu.Lock()
+	entries, cost := len(c.data), c.cost
+	c.mu.Unlock()
+	return Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   entries,
+		Cost:      cost,
+	}
+}
+
+func (c *Cache[K, V]) expired(e *entry[K, V]) bool {
+	return !e.expires.IsZero() && time.Now().After(e.expires)
+}
+
+// evict removes the least recently used entries while the cache is over its
+// limits. c.mu must be held.
+func (c *Cache[K, V]) evict() {
+	for c.overLimits() {
+		c.remove(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *Cache[K, V]) overLimits() bool {
+	if c.order.Len() == 0 {
+		return false
+	}
+	return (c.opt.MaxEntries > 0 && c.order.Len() > c.opt.MaxEntries) ||
+		(c.opt.MaxCost > 0 && c.cost > c.opt.MaxCost)
+}
+
+func (c *Cache[K, V]) remove(el *list.Element) {
+	e := c.order.Remove(el).(*entry[K, V])
+	delete(c.data, e.key)
+	c.cost -= e.cost
 }
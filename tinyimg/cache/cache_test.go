@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	c := New(Options[string, int]{TTL: 20 * time.Millisecond})
+	c.Set("a", 1)
+	c.SetWithTTL("b", 2, 0)
+	c.SetWithTTL("c", 3, time.Hour)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get(a) = %d, %v before it expired", v, ok)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expired entry was returned")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Fatalf("entry %s expired with its own TTL", key)
+		}
+	}
+	if s := c.Stats(); s.Entries != 2 || s.Evictions != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	c := New(Options[string, int]{TTL: 20 * time.Millisecond})
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.SetWithTTL("c", 3, 0)
+	time.Sleep(30 * time.Millisecond)
+	// expired entries stay until they are read or pruned
+	if n := c.Len(); n != 3 {
+		t.Fatalf("len %d before pruning", n)
+	}
+	if n := c.Prune(); n != 2 {
+		t.Fatalf("pruned %d entries, want 2", n)
+	}
+	if s := c.Stats(); s.Entries != 1 || s.Evictions != 2 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := New(Options[string, int]{MaxEntries: 3})
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	// reading a makes b the least recently used
+	c.Get("a")
+	c.Set("d", 4)
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b was not evicted")
+	}
+	// replacing c makes it the most recently used
+	c.Set("c", 30)
+	c.Set("e", 5)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("a was not evicted")
+	}
+	for key, want := range map[string]int{"c": 30, "d": 4, "e": 5} {
+		if v, ok := c.Get(key); !ok || v != want {
+			t.Fatalf("Get(%s) = %d, %v, want %d", key, v, ok, want)
+		}
+	}
+	if s := c.Stats(); s.Entries != 3 || s.Evictions != 2 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestCacheMaxCost(t *testing.T) {
+	c := New(Options[string, []byte]{
+		MaxCost: 10,
+		Cost:    func(_ string, v []byte) int64 { return int64(len(v)) },
+	})
+	c.Set("a", make([]byte, 4))
+	c.Set("b", make([]byte, 4))
+	if s := c.Stats(); s.Cost != 8 || s.Entries != 2 {
+		t.Fatalf("stats %+v", s)
+	}
+	// a and b are evicted to fit c
+	c.Set("c", make([]byte, 8))
+	if s := c.Stats(); s.Cost != 8 || s.Entries != 1 || s.Evictions != 2 {
+		t.Fatalf("stats %+v", s)
+	}
+	// an entry over MaxCost on its own is not kept
+	c.Set("d", make([]byte, 11))
+	if s := c.Stats(); s.Cost != 0 || s.Entries != 0 || s.Evictions != 4 {
+		t.Fatalf("stats %+v", s)
+	}
+	// replacing an entry replaces its cost
+	c.Set("e", make([]byte, 6))
+	c.Set("e", make([]byte, 2))
+	if s := c.Stats(); s.Cost != 2 || s.Entries != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+	c.Delete("e")
+	if s := c.Stats(); s.Cost != 0 || s.Entries != 0 {
+		t.Fatalf("stats %+v after delete", s)
+	}
+}
+
+func TestCacheCounters(t *testing.T) {
+	c := New(Options[string, int]{MaxEntries: 1})
+	c.Get("a")
+	c.Set("a", 1)
+	c.Get("a")
+	c.Get("a")
+	c.Set("b", 2)
+	c.Get("a")
+	want := Stats{Hits: 2, Misses: 2, Evictions: 1, Entries: 1}
+	if s := c.Stats(); s != want {
+		t.Fatalf("stats %+v, want %+v", s, want)
+	}
+	c.Clear()
+	if s := c.Stats(); s.Entries != 0 || s.Hits != 2 {
+		t.Fatalf("stats %+v after clear", s)
+	}
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	errLoad := errors.New("load failed")
+	calls := 0
+	c := New(Options[string, int]{
+		Loader: func(key string) (int, error) {
+			calls++
+			if key == "bad" {
+				return 0, errLoad
+			}
+			return len(key), nil
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		v, err := c.GetOrLoad("abc")
+		if err != nil || v != 3 {
+			t.Fatalf("GetOrLoad(abc) = %d, %v", v, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("loader called %d times for a cached key", calls)
+	}
+
+	// errors are returned and not cached
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetOrLoad("bad"); !errors.Is(err, errLoad) {
+			t.Fatalf("GetOrLoad(bad) = %v", err)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("loader called %d times, want 3", calls)
+	}
+	if _, ok := c.Get("bad"); ok {
+		t.Fatal("failed load was cached")
+	}
+
+	// without a loader a missing key is the zero value
+	empty := NewCache[string, int]()
+	if v, err := empty.GetOrLoad("abc"); v != 0 || err != nil {
+		t.Fatalf("GetOrLoad without a loader = %d, %v", v, err)
+	}
+}
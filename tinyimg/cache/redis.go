@@ -1,16 +1,139 @@
 package cache
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/dunkbing/tinyimg/tinyimg/config"
 	"github.com/redis/go-redis/v9"
 )
 
-var redisClient *redis.Client
+var (
+	redisOnce   sync.Once
+	redisClient *redis.Client
+	redisErr    error
+)
 
-func GetRedisClient() *redis.Client {
-	if redisClient == nil {
-		opt, _ := redis.ParseURL(config.RedisUrl)
+// GetRedisClient returns the client for REDIS_URL shared by everything
+// kept in Redis. It is created on the first call; an unset or invalid URL
+// is an error on every call.
+func GetRedisClient() (*redis.Client, error) {
+	redisOnce.Do(func() {
+		redisUrl := config.GetConfig().App.RedisUrl
+		if redisUrl == "" {
+			redisErr = errors.New("REDIS_URL is not set")
+			return
+		}
+		opt, err := redis.ParseURL(redisUrl)
+		if err != nil {
+			redisErr = fmt.Errorf("invalid REDIS_URL: %w", err)
+			return
+		}
 		redisClient = redis.NewClient(opt)
+	})
+	return redisClient, redisErr
+}
+
+// redisTimeout bounds every Redis call, so a slow Redis degrades to cache
+// misses instead of stalling conversions.
+const redisTimeout = 2 * time.Second
+
+// RedisCache is a Store keeping JSON encoded values in Redis under a key
+// prefix. Entries expire after the cache's TTL. Redis errors are logged and
+// treated as misses.
+type RedisCache[K comparable, V any] struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// NewRedisCache creates a RedisCache. A zero ttl keeps entries until they
+// are deleted or evicted by Redis.
+func NewRedisCache[K comparable, V any](client *redis.Client, prefix string, ttl time.Duration) *RedisCache[K, V] {
+	return &RedisCache[K, V]{client: client, prefix: prefix, ttl: ttl}
+}
+
+func (c *RedisCache[K, V]) key(key K) string {
+	return c.prefix + fmt.Sprint(key)
+}
+
+// Get gets a value from Redis.
+func (c *RedisCache[K, V]) Get(key K) (V, bool) {
+	var value V
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	data, err := c.client.Get(ctx, c.key(key)).Bytes()
+	if err == nil {
+		err = json.Unmarshal(data, &value)
+	}
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.Error("Error reading cache entry", "key", c.key(key), "err", err)
+		}
+		c.misses.Add(1)
+		var zero V
+		return zero, false
+	}
+	c.hits.Add(1)
+	return value, true
+}
+
+// Set sets a value in Redis.
+func (c *RedisCache[K, V]) Set(key K, value V) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		slog.Error("Error encoding cache entry", "key", c.key(key), "err", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err = c.client.Set(ctx, c.key(key), data, c.ttl).Err(); err != nil {
+		slog.Error("Error writing cache entry", "key", c.key(key), "err", err)
+	}
+}
+
+// Delete deletes a value from Redis.
+func (c *RedisCache[K, V]) Delete(key K) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := c.client.Del(ctx, c.key(key)).Err(); err != nil {
+		slog.Error("Error deleting cache entry", "key", c.key(key), "err", err)
+	}
+}
+
+// Clear deletes every value under the cache's prefix.
+func (c *RedisCache[K, V]) Clear() {
+	ctx := context.Background()
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		if err := c.client.Del(ctx, iter.Val()).Err(); err != nil {
+			slog.Error("Error clearing cache entry", "key", iter.Val(), "err", err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		slog.Error("Error clearing cache", "prefix", c.prefix, "err", err)
+	}
+}
+
+// Prune does nothing, Redis expires the entries itself.
+func (c *RedisCache[K, V]) Prune() int {
+	return 0
+}
+
+// Stats returns the hits and misses of this replica.
+func (c *RedisCache[K, V]) Stats() Stats {
+	return Stats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
 	}
-	return redisClient
 }
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+type result struct {
+	Name string
+	Size int64
+}
+
+// newTestRedis starts a miniredis server and returns it with a function
+// connecting new clients to it.
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, func() *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	return mr, func() *redis.Client {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+}
+
+func TestRedisCacheShared(t *testing.T) {
+	_, newClient := newTestRedis(t)
+	a := NewRedisCache[string, result](newClient(), "test:", 0)
+	b := NewRedisCache[string, result](newClient(), "test:", 0)
+
+	want := result{Name: "a.webp", Size: 42}
+	a.Set("a", want)
+	if got, ok := b.Get("a"); !ok || got != want {
+		t.Fatalf("get from the other replica = %+v, %v", got, ok)
+	}
+	if _, ok := b.Get("missing"); ok {
+		t.Fatal("got a value that was never set")
+	}
+	if s := b.Stats(); s.Hits != 1 || s.Misses != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+	// the stats are per replica
+	if s := a.Stats(); s.Hits != 0 || s.Misses != 0 {
+		t.Fatalf("stats of the writer %+v", s)
+	}
+}
+
+func TestRedisCacheTTL(t *testing.T) {
+	mr, newClient := newTestRedis(t)
+	c := NewRedisCache[string, result](newClient(), "test:", time.Minute)
+
+	c.Set("a", result{Name: "a.webp"})
+	if ttl := mr.TTL("test:a"); ttl != time.Minute {
+		t.Fatalf("ttl = %v, want %v", ttl, time.Minute)
+	}
+	mr.FastForward(30 * time.Second)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("entry expired early")
+	}
+	mr.FastForward(31 * time.Second)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("entry did not expire")
+	}
+}
+
+func TestRedisCacheDeleteAndClear(t *testing.T) {
+	mr, newClient := newTestRedis(t)
+	client := newClient()
+	c := NewRedisCache[string, result](client, "test:", 0)
+	other := NewRedisCache[string, result](client, "other:", 0)
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, result{Name: key})
+	}
+	other.Set("a", result{Name: "kept"})
+
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("deleted entry is still there")
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Fatal("delete removed another entry")
+	}
+
+	c.Clear()
+	if keys := mr.Keys(); len(keys) != 1 || keys[0] != "other:a" {
+		t.Fatalf("keys after clear = %v, want [other:a]", keys)
+	}
+	if got, ok := other.Get("a"); !ok || got.Name != "kept" {
+		t.Fatal("clear removed an entry of another prefix")
+	}
+}
+
+func TestRedisCacheMissOnError(t *testing.T) {
+	mr, newClient := newTestRedis(t)
+	c := NewRedisCache[string, result](newClient(), "test:", 0)
+	c.Set("a", result{Name: "a.webp"})
+
+	mr.Close()
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("got a value while Redis is down")
+	}
+	if s := c.Stats(); s.Misses != 1 {
+		t.Fatalf("stats %+v, want a miss", s)
+	}
+	// writes fail without panicking
+	c.Set("b", result{Name: "b.webp"})
+	c.Delete("a")
+	c.Clear()
+}
+
+func TestRedisCacheBadValue(t *testing.T) {
+	mr, newClient := newTestRedis(t)
+	c := NewRedisCache[string, result](newClient(), "test:", 0)
+
+	mr.Set("test:a", "not json")
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("decoded an invalid entry")
+	}
+}
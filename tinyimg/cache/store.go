@@ -0,0 +1,19 @@
+package cache
+
+// Store is a cache that conversion state can be kept in. Cache keeps it in
+// process memory, RedisCache shares it between replicas.
+type Store[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	Set(key K, value V)
+	Delete(key K)
+	Clear()
+	// Prune removes the expired entries of stores that don't expire them
+	// on their own, and returns how many there were.
+	Prune() int
+	Stats() Stats
+}
+
+var (
+	_ Store[string, any] = (*Cache[string, any])(nil)
+	_ Store[string, any] = (*RedisCache[string, any])(nil)
+)
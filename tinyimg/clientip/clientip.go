@@ -0,0 +1,158 @@
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver finds the address of the client of a request. The forwarding
+// headers are only believed when they were added by trusted proxies, since
+// clients can send them too.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver creates a Resolver trusting the proxies in the given CIDRs.
+// Bare addresses are accepted as a single host.
+func NewResolver(cidrs []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, n)
+	}
+	return r, nil
+}
+
+// ClientIP returns the address of the client of req. When the peer is a
+// trusted proxy, the hops listed in the Forwarded header, or else in
+// X-Forwarded-For, are walked from the closest one and the first address
+// that isn't a trusted proxy is the client. X-Real-IP is used when a trusted
+// peer sent neither. A hop that isn't an address, like "unknown", stops the
+// walk at the proxy that reported it.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	ip := remoteIP(req)
+	if !r.isTrusted(ip) {
+		return ip
+	}
+
+	hops := forwardedFor(req.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = splitList(req.Header.Values("X-Forwarded-For"))
+	}
+	if len(hops) == 0 {
+		if realIP := parseIP(req.Header.Get("X-Real-IP")); realIP != "" {
+			return realIP
+		}
+		return ip
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseIP(hops[i])
+		if hop == "" {
+			break
+		}
+		ip = hop
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func (r *Resolver) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range r.trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address of the peer of req.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// forwardedFor returns the for= parameters of Forwarded header values
+// (RFC 7239), the client first.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				hops = append(hops, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return hops
+}
+
+// splitList splits comma separated header values.
+func splitList(values []string) []string {
+	var items []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// parseIP returns the address in a hop, which may have a port and IPv6
+// brackets, or "" when it has none.
+func parseIP(hop string) string {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	ip := net.ParseIP(hop)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the client address ip.
+func NewContext(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, contextKey{}, ip)
+}
+
+// FromRequest returns the client address stored in the request's context,
+// or the address of its peer when there is none.
+func FromRequest(req *http.Request) string {
+	if ip, ok := req.Context().Value(contextKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(req)
+}
@@ -0,0 +1,112 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	r, err := NewResolver([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		peer    string
+		headers map[string][]string
+		want    string
+	}{
+		{"no headers", "203.0.113.9:1234", nil, "203.0.113.9"},
+		{"untrusted peer spoofing xff", "203.0.113.9:1234",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.9"},
+		{"untrusted peer spoofing forwarded", "203.0.113.9:1234",
+			map[string][]string{"Forwarded": {"for=198.51.100.1"}}, "203.0.113.9"},
+		{"untrusted peer spoofing x-real-ip", "203.0.113.9:1234",
+			map[string][]string{"X-Real-IP": {"198.51.100.1"}}, "203.0.113.9"},
+		{"trusted peer without headers", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"xff single hop", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"xff through trusted proxies", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1, 10.0.0.3, 10.0.0.2"}}, "198.51.100.1"},
+		{"xff stops at the first untrusted hop", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"192.0.2.7, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"xff on several lines", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"192.0.2.7, 198.51.100.1", "10.0.0.2"}}, "198.51.100.1"},
+		{"xff with ports", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1:5555, [2001:db8::1]:443"}}, "198.51.100.1"},
+		{"xff malformed hop", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1, not-an-ip, 10.0.0.2"}}, "10.0.0.2"},
+		{"xff malformed closest hop", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1, 300.1.1.1"}}, "10.0.0.1"},
+		{"xff empty items", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {" , 198.51.100.1,,"}}, "198.51.100.1"},
+		{"forwarded", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for=198.51.100.1;proto=https;by=10.0.0.1"}}, "198.51.100.1"},
+		{"forwarded case insensitive key", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"For=198.51.100.1"}}, "198.51.100.1"},
+		{"forwarded quoted ipv6 with port", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}}, "2001:db8:cafe::17"},
+		{"forwarded quoted ipv4 with port", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {`for="198.51.100.1:80"`}}, "198.51.100.1"},
+		{"forwarded through trusted proxies", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {`for=192.0.2.7, for=198.51.100.1, for="[2001:db8::1]"`}}, "198.51.100.1"},
+		{"forwarded on several lines", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for=192.0.2.7", "for=198.51.100.1", "for=10.0.0.2"}}, "198.51.100.1"},
+		{"forwarded unknown", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for=198.51.100.1, for=unknown, for=10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded obfuscated", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {`for=198.51.100.1, for="_hidden"`}}, "10.0.0.1"},
+		{"forwarded wins over xff", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"192.0.2.7"}}, "198.51.100.1"},
+		{"forwarded without for", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"proto=https"}, "X-Forwarded-For": {"192.0.2.7"}}, "192.0.2.7"},
+		{"x-real-ip", "10.0.0.1:1234",
+			map[string][]string{"X-Real-IP": {"198.51.100.1"}}, "198.51.100.1"},
+		{"x-real-ip malformed", "10.0.0.1:1234",
+			map[string][]string{"X-Real-IP": {"nobody"}}, "10.0.0.1"},
+		{"xff wins over x-real-ip", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"192.0.2.7"}, "X-Real-IP": {"198.51.100.1"}}, "192.0.2.7"},
+		{"trusted ipv6 peer", "[2001:db8::1]:443",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"untrusted ipv6 peer", "[2001:db8::2]:443",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "2001:db8::2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.peer
+			for name, values := range tt.headers {
+				for _, v := range values {
+					req.Header.Add(name, v)
+				}
+			}
+			if got := r.ClientIP(req); got != tt.want {
+				t.Fatalf("ClientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	if _, err := NewResolver([]string{"10.0.0.0/8", "127.0.0.1", "::1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, cidr := range []string{"10.0.0.0/33", "localhost", ""} {
+		if _, err := NewResolver([]string{cidr}); err == nil {
+			t.Errorf("accepted %q", cidr)
+		}
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+	if ip := FromRequest(req); ip != "203.0.113.9" {
+		t.Fatalf("FromRequest() = %s without a context value", ip)
+	}
+	req = req.WithContext(NewContext(req.Context(), "198.51.100.1"))
+	if ip := FromRequest(req); ip != "198.51.100.1" {
+		t.Fatalf("FromRequest() = %s", ip)
+	}
+}
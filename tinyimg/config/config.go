@@ -1,109 +1,286 @@
 package config
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/dunkbing/tinyimg/tinyimg/janitor"
 	"github.com/dunkbing/tinyimg/tinyimg/jpeg"
 	"github.com/dunkbing/tinyimg/tinyimg/png"
+	"github.com/dunkbing/tinyimg/tinyimg/pool"
+	"github.com/dunkbing/tinyimg/tinyimg/stat"
+	"github.com/dunkbing/tinyimg/tinyimg/storage"
+	"github.com/dunkbing/tinyimg/tinyimg/tracing"
+	"github.com/dunkbing/tinyimg/tinyimg/webhook"
 	"github.com/dunkbing/tinyimg/tinyimg/webp"
+	"log"
 	"os"
-	"path"
 	"path/filepath"
-	"strings"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var AllowedOrigins = strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",")
-var HostUrl = os.Getenv("HOST_URL")
-var TgBotToken = os.Getenv("TG_BOT_TOKEN")
-var RedisUrl = os.Getenv("REDIS_URL")
+// CacheOptions represent the limits of the conversion results cache.
+type CacheOptions struct {
+	// Backend is either "memory" or "redis".
+	Backend string `json:"backend"`
+	// RedisPrefix is prepended to the keys of the results kept in Redis,
+	// "tinyimg:result:" by default.
+	RedisPrefix string `json:"redisPrefix"`
+	// TTL is how long a result is reused after the conversion.
+	TTL time.Duration `json:"ttl"`
+	// MaxEntries is the number of results kept before the least recently
+	// used ones are evicted.
+	MaxEntries int `json:"maxEntries"`
+}
+
+// RateLimitOptions represent the per-client request rate limit.
+type RateLimitOptions struct {
+	// Backend is "memory", which limits each replica on its own, or
+	// "redis", which shares the limit between replicas through REDIS_URL.
+	// Changing it needs a restart.
+	Backend string `json:"backend"`
+	// RedisPrefix is prepended to the keys of the clients kept in Redis.
+	RedisPrefix string `json:"redisPrefix"`
+	// Rate is the number of requests per second a client may sustain.
+	Rate float64 `json:"rate"`
+	// Burst is the number of requests a client may send at once.
+	Burst int `json:"burst"`
+}
+
+// Preset is a named set of encoding settings that clients select with the
+// preset field instead of passing every parameter.
+type Preset struct {
+	// Formats are the output formats used when the request names none.
+	Formats []string `json:"formats"`
+	// Quality overrides the quality of every format when it is set.
+	Quality int `json:"quality,omitempty"`
+	// Width and Height bound the size of the output, which keeps its aspect
+	// ratio and is never enlarged. Zero means no bound.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Metadata is "strip" or "keep". When empty the encoder options apply.
+	Metadata string `json:"metadata,omitempty"`
+	// MaxFileSize is the largest image accepted with the preset. It can only
+	// lower the global limit.
+	MaxFileSize int64 `json:"maxFileSize,omitempty"`
+}
 
 // App represents application persistent configuration values.
 type App struct {
+	// Listen is the address the server listens on.
+	Listen string `json:"listen"`
+	// HostUrl is the public URL of the server, the base of the links to
+	// converted images.
+	HostUrl string `json:"hostUrl"`
+	// AllowedOrigins are the origins allowed to call the API from a browser.
+	AllowedOrigins []string `json:"allowedOrigins"`
+	// TrustedProxies are the CIDRs of the proxies allowed to set the
+	// Forwarded, X-Forwarded-For and X-Real-IP headers. Without any, the
+	// client is the peer of the connection.
+	TrustedProxies []string `json:"trustedProxies"`
+
 	InDir   string        `json:"inDir"`
 	OutDir  string        `json:"outDir"`
 	Target  string        `json:"target"`
 	JpegOpt *jpeg.Options `json:"jpegOpt"`
 	PngOpt  *png.Options  `json:"pngOpt"`
 	WebpOpt *webp.Options `json:"webpOpt"`
+	PoolOpt *pool.Options `json:"poolOpt"`
+
+	StorageOpt *storage.Options `json:"storageOpt"`
+	JanitorOpt *janitor.Options `json:"janitorOpt"`
+	CacheOpt   *CacheOptions    `json:"cacheOpt"`
+	StatOpt    *stat.Options    `json:"statOpt"`
+	TraceOpt   *tracing.Options `json:"traceOpt"`
+
+	// MaxFileSize is the largest image accepted, alone or inside a batch.
+	MaxFileSize int64 `json:"maxFileSize"`
+	// MaxBatchSize is the largest request body accepted by the upload routes.
+	MaxBatchSize int64 `json:"maxBatchSize"`
+	// MaxBatchFiles is the largest number of images in a single batch.
+	MaxBatchFiles int `json:"maxBatchFiles"`
+
+	WebhookDir string           `json:"webhookDir"`
+	WebhookOpt *webhook.Options `json:"webhookOpt"`
+
+	RateLimitOpt *RateLimitOptions `json:"rateLimitOpt"`
+	// Presets are the encoding presets, keyed by name.
+	Presets map[string]*Preset `json:"presets"`
+	// Tools maps the external tools, e.g. "cwebp", to the path they are run
+	// from. Tools without an entry are looked up in PATH.
+	Tools map[string]string `json:"tools"`
+
+	// RedisUrl is the Redis server of the redis backends.
+	RedisUrl string `json:"redisUrl"`
+	// WebhookSecret signs webhook callbacks. Callbacks are disabled without it.
+	WebhookSecret string `json:"webhookSecret"`
+	// TgBotToken is the token of the Telegram bot.
+	TgBotToken string `json:"tgBotToken"`
 }
 
-// Config represents the application settings.
+// Config represents the application settings. A Config is never modified
+// once it is returned by GetConfig; reloads swap in a new one, so callers
+// should get it again for every request rather than keep it.
 type Config struct {
 	App *App
+	// File is the configuration file the settings were loaded from, if any.
+	File string
 }
 
-var config_ *Config
+var (
+	current     atomic.Pointer[Config]
+	defaultOnce sync.Once
+)
 
-// GetConfig returns a new instance of Config.
+// GetConfig returns the current configuration, set by Load, or the defaults
+// overridden by the environment when Load wasn't called.
 func GetConfig() *Config {
-	if config_ == nil {
-		c := &Config{}
-		c.App, _ = defaults()
-		config_ = c
+	if c := current.Load(); c != nil {
+		return c
 	}
-
-	return config_
+	defaultOnce.Do(func() {
+		if current.Load() != nil {
+			return
+		}
+		if _, err := Load(flag.NewFlagSet("tinyimg", flag.ContinueOnError), nil); err != nil {
+			log.Fatal("Invalid configuration: ", err)
+		}
+	})
+	return current.Load()
 }
 
 // GetAppConfig returns the application configuration.
 func (c *Config) GetAppConfig() map[string]interface{} {
 	return map[string]interface{}{
+		"listen":         c.App.Listen,
+		"hostUrl":        c.App.HostUrl,
+		"allowedOrigins": c.App.AllowedOrigins,
+		"trustedProxies": c.App.TrustedProxies,
+
 		"inDir":   c.App.InDir,
 		"outDir":  c.App.OutDir,
 		"target":  c.App.Target,
 		"jpegOpt": c.App.JpegOpt,
 		"pngOpt":  c.App.PngOpt,
 		"webpOpt": c.App.WebpOpt,
+		"poolOpt": c.App.PoolOpt,
+
+		"storageOpt": c.App.StorageOpt,
+		"janitorOpt": c.App.JanitorOpt,
+		"cacheOpt":   c.App.CacheOpt,
+		"statOpt":    c.App.StatOpt,
+		"traceOpt":   c.App.TraceOpt,
+
+		"maxFileSize":   c.App.MaxFileSize,
+		"maxBatchSize":  c.App.MaxBatchSize,
+		"maxBatchFiles": c.App.MaxBatchFiles,
+
+		"webhookDir": c.App.WebhookDir,
+		"webhookOpt": c.App.WebhookOpt,
+
+		"rateLimitOpt": c.App.RateLimitOpt,
+		"presets":      c.App.Presets,
+		"tools":        c.App.Tools,
+
+		"redisUrl":      c.App.RedisUrl,
+		"webhookSecret": c.App.WebhookSecret,
+		"tgBotToken":    c.App.TgBotToken,
 	}
 }
 
-// RestoreDefaults sets the app configuration to defaults.
-func (c *Config) RestoreDefaults() (err error) {
-	var a *App
-	a, err = defaults()
+// RestoreDefaults swaps in the default settings, overridden by the
+// environment. Like Reload, only the reloadable settings change.
+func (c *Config) RestoreDefaults() error {
+	a, err := defaults()
 	if err != nil {
 		return err
 	}
-	c.App = a
+	if err = errors.Join(applyEnv(a), a.validate()); err != nil {
+		return err
+	}
+	swap(a)
 	return nil
 }
 
-// defaults returns the application configuration defaults.
+// defaults returns the application configuration defaults. The
+// directories are under the user's home directory.
 func defaults() (*App, error) {
-	a := &App{
-		Target:  "webp",
-		JpegOpt: &jpeg.Options{Quality: 80},
-		PngOpt:  &png.Options{Quality: 80},
-		WebpOpt: &webp.Options{Lossless: false, Quality: 80},
-	}
 	wd, err := os.UserHomeDir()
 	if err != nil {
 		fmt.Printf("failed to get user directory: %v", err)
 		return nil, err
 	}
+	root := filepath.Join(wd, "tinyimg")
 
-	od := path.Join(wd, "tinyimg", "output")
-	cp := filepath.Clean(od)
+	a := &App{
+		Listen:  ":8080",
+		InDir:   filepath.Join(root, "input"),
+		OutDir:  filepath.Join(root, "output"),
+		Target:  "webp",
+		JpegOpt: &jpeg.Options{Quality: 80, Timeout: 30 * time.Second},
+		PngOpt:  &png.Options{Quality: 80, Timeout: time.Minute},
+		WebpOpt: &webp.Options{Lossless: false, Quality: 80, Timeout: 30 * time.Second},
+		PoolOpt: &pool.Options{
+			MaxWorkers: runtime.NumCPU(),
+			PerEncoder: map[string]int{},
+			QueueDepth: 64,
+			RetryAfter: 5,
+		},
+		TraceOpt: &tracing.Options{
+			Exporter:    "none",
+			SampleRatio: 1,
+			ServiceName: "tinyimg",
+		},
+		CacheOpt: &CacheOptions{
+			Backend:    "memory",
+			TTL:        24 * time.Hour,
+			MaxEntries: 10000,
+		},
 
-	if _, err = os.Stat(od); os.IsNotExist(err) {
-		if err = os.MkdirAll(od, 0777); err != nil {
-			od = "./"
-			fmt.Printf("failed to create default output directory: %v", err)
-			return nil, err
-		}
+		MaxFileSize:   10 * 1024 * 1024,
+		MaxBatchSize:  512 * 1024 * 1024,
+		MaxBatchFiles: 500,
+		WebhookDir:    filepath.Join(root, "webhooks"),
+		WebhookOpt: &webhook.Options{
+			MaxAttempts: 8,
+			BaseDelay:   5 * time.Second,
+			MaxDelay:    time.Hour,
+			Timeout:     10 * time.Second,
+		},
+		RateLimitOpt: &RateLimitOptions{
+			Backend:     "memory",
+			RedisPrefix: "tinyimg:ratelimit:",
+			Rate:        15,
+			Burst:       30,
+		},
+		Tools: map[string]string{},
+		Presets: map[string]*Preset{
+			"thumbnail": {Formats: []string{"webp"}, Quality: 70, Width: 320, Height: 320},
+			"hero":      {Formats: []string{"webp", "jpg"}, Quality: 80, Width: 1920},
+			"archive":   {Formats: []string{"png"}, Quality: 100, Metadata: "keep"},
+		},
 	}
-	a.OutDir = cp
-
-	id := path.Join(wd, "tinyimg", "input")
-	cip := filepath.Clean(id)
-
-	if _, err = os.Stat(id); os.IsNotExist(err) {
-		if err = os.MkdirAll(id, 0777); err != nil {
-			id = "./"
-			fmt.Printf("failed to create default input directory: %v", err)
-			return nil, err
-		}
+	a.StorageOpt = &storage.Options{
+		Backend: "local",
+		Dir:     a.OutDir,
+		UseSSL:  true,
+	}
+	a.StatOpt = &stat.Options{
+		Backend:       "file",
+		File:          filepath.Join(root, "stats.json"),
+		RedisPrefix:   "tinyimg:stats:",
+		FlushInterval: 10 * time.Second,
+	}
+	a.JanitorOpt = &janitor.Options{
+		Interval: 10 * time.Minute,
+		Policies: []janitor.Policy{
+			{Dir: a.InDir, TTL: 24 * time.Hour, MaxBytes: 1024 * 1024 * 1024},
+			{Dir: a.OutDir, TTL: 7 * 24 * time.Hour, MaxBytes: 3 * 1024 * 1024 * 1024},
+		},
 	}
-	a.InDir = cip
 
 	return a, nil
 }
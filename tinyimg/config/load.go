@@ -0,0 +1,466 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dunkbing/tinyimg/tinyimg/clientip"
+	"github.com/dunkbing/tinyimg/tinyimg/janitor"
+)
+
+// Load builds the configuration in layers: the defaults, then the TOML file
+// given by --config or CONFIG_FILE, then the environment, then the flags
+// registered on fs and parsed from args. The result is validated, its
+// directories are created and it becomes the one returned by GetConfig.
+// Reload later rebuilds it from the same file, environment and flags.
+//
+// Keys of the file are the field names of App, matched case insensitively,
+// and durations are strings like "24h". Only TOML is read, on purpose: one
+// format keeps the docs, the examples and --print-config in step.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	f := &App{RateLimitOpt: &RateLimitOptions{}}
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "TOML configuration `file`")
+	fs.StringVar(&f.Listen, "listen", "", "`address` the server listens on")
+	fs.StringVar(&f.InDir, "in-dir", "", "`dir`ectory of the uploaded images")
+	fs.StringVar(&f.OutDir, "out-dir", "", "`dir`ectory of the converted images")
+	fs.StringVar(&f.Target, "target", "", "default output `format`")
+	fs.Int64Var(&f.MaxFileSize, "max-file-size", 0, "largest image accepted, in `bytes`")
+	fs.Int64Var(&f.MaxBatchSize, "max-batch-size", 0, "largest upload body accepted, in `bytes`")
+	fs.IntVar(&f.MaxBatchFiles, "max-batch-files", 0, "largest number of images in a batch")
+	fs.Float64Var(&f.RateLimitOpt.Rate, "rate-limit", 0, "requests per second a client may sustain")
+	fs.IntVar(&f.RateLimitOpt.Burst, "rate-burst", 0, "requests a client may send at once")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	build := func() (*App, error) {
+		a, err := defaults()
+		if err != nil {
+			return nil, err
+		}
+		if *file != "" {
+			if err = loadFile(a, *file); err != nil {
+				return nil, err
+			}
+		}
+		envErr := applyEnv(a)
+		applyFlags(a, f, fs)
+		if err = errors.Join(envErr, a.validate()); err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+	a, err := build()
+	if err != nil {
+		return nil, err
+	}
+	if err = a.makeDirs(); err != nil {
+		return nil, err
+	}
+
+	c := &Config{App: a, File: *file}
+	reloadMu.Lock()
+	current.Store(c)
+	rebuild, watchedFile = build, *file
+	reloadMu.Unlock()
+	return c, nil
+}
+
+// loadFile overrides a with the settings of a TOML file. Unknown keys are
+// errors so that typos don't go unnoticed.
+func loadFile(a *App, path string) error {
+	in, out := a.InDir, a.OutDir
+	md, err := toml.DecodeFile(path, a)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return fmt.Errorf("config file %s: unknown keys %v", path, keys)
+	}
+	a.followDirs(in, out)
+	return nil
+}
+
+// applyEnv overrides a with the environment variables that are set. Lists
+// are comma separated, durations are strings like "24h" and sizes are in
+// bytes.
+func applyEnv(a *App) error {
+	var e env
+	in, out := a.InDir, a.OutDir
+	e.string(&a.Listen, "LISTEN_ADDR")
+	e.string(&a.HostUrl, "HOST_URL")
+	e.list(&a.AllowedOrigins, "ALLOWED_ORIGINS")
+	// CIDRs of the proxies, e.g. the ingress, whose forwarding headers are
+	// trusted to find client addresses
+	e.list(&a.TrustedProxies, "TRUSTED_PROXIES")
+	e.string(&a.InDir, "INPUT_DIR")
+	e.string(&a.OutDir, "OUTPUT_DIR")
+	a.followDirs(in, out)
+
+	e.int(&a.PoolOpt.MaxWorkers, "ENCODER_MAX_WORKERS")
+	e.int(&a.PoolOpt.QueueDepth, "ENCODER_QUEUE_DEPTH")
+	// format=limit pairs, e.g. "png=2,webp=4"
+	e.pairs("ENCODER_LIMITS", func(encoder, limit string) bool {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return false
+		}
+		if a.PoolOpt.PerEncoder == nil {
+			a.PoolOpt.PerEncoder = map[string]int{}
+		}
+		a.PoolOpt.PerEncoder[encoder] = n
+		return true
+	})
+	// tool=path pairs, e.g. "cwebp=/opt/libwebp/bin/cwebp"
+	e.pairs("TOOL_PATHS", func(tool, path string) bool {
+		if a.Tools == nil {
+			a.Tools = map[string]string{}
+		}
+		a.Tools[tool] = path
+		return true
+	})
+
+	e.string(&a.StorageOpt.Backend, "STORAGE_BACKEND")
+	e.string(&a.StorageOpt.Endpoint, "S3_ENDPOINT")
+	e.string(&a.StorageOpt.Region, "S3_REGION")
+	e.string(&a.StorageOpt.Bucket, "S3_BUCKET")
+	e.string(&a.StorageOpt.Prefix, "S3_PREFIX")
+	e.string(&a.StorageOpt.AccessKey, "S3_ACCESS_KEY")
+	e.string(&a.StorageOpt.SecretKey, "S3_SECRET_KEY")
+	e.bool(&a.StorageOpt.UseSSL, "S3_USE_SSL")
+
+	e.duration(&a.JanitorOpt.Interval, "JANITOR_INTERVAL")
+	e.bool(&a.JanitorOpt.DryRun, "JANITOR_DRY_RUN")
+	if p := a.policy(a.InDir); p != nil {
+		e.duration(&p.TTL, "INPUT_TTL")
+		e.int64(&p.MaxBytes, "INPUT_MAX_BYTES")
+	}
+	if p := a.policy(a.OutDir); p != nil {
+		e.duration(&p.TTL, "OUTPUT_TTL")
+		e.int64(&p.MaxBytes, "OUTPUT_MAX_BYTES")
+	}
+
+	e.int64(&a.MaxFileSize, "UPLOAD_MAX_FILE_SIZE")
+	e.int64(&a.MaxBatchSize, "UPLOAD_MAX_BATCH_SIZE")
+	e.int(&a.MaxBatchFiles, "UPLOAD_MAX_BATCH_FILES")
+
+	e.string(&a.StatOpt.Backend, "STATS_BACKEND")
+	e.duration(&a.StatOpt.FlushInterval, "STATS_FLUSH_INTERVAL")
+
+	e.string(&a.TraceOpt.Exporter, "TRACE_EXPORTER")
+	e.string(&a.TraceOpt.Endpoint, "TRACE_ENDPOINT")
+	e.bool(&a.TraceOpt.Insecure, "TRACE_INSECURE")
+	e.float(&a.TraceOpt.SampleRatio, "TRACE_SAMPLE_RATIO")
+
+	e.string(&a.CacheOpt.Backend, "CACHE_BACKEND")
+	e.string(&a.CacheOpt.RedisPrefix, "CACHE_REDIS_PREFIX")
+	e.duration(&a.CacheOpt.TTL, "CACHE_TTL")
+	e.int(&a.CacheOpt.MaxEntries, "CACHE_MAX_ENTRIES")
+
+	e.string(&a.RateLimitOpt.Backend, "RATE_LIMIT_BACKEND")
+	e.float(&a.RateLimitOpt.Rate, "RATE_LIMIT")
+	e.int(&a.RateLimitOpt.Burst, "RATE_BURST")
+
+	e.string(&a.RedisUrl, "REDIS_URL")
+	e.string(&a.WebhookSecret, "WEBHOOK_SECRET")
+	e.string(&a.TgBotToken, "TG_BOT_TOKEN")
+	return errors.Join(e.errs...)
+}
+
+// applyFlags overrides a with the flags set on the command line, which were
+// parsed into f.
+func applyFlags(a, f *App, fs *flag.FlagSet) {
+	in, out := a.InDir, a.OutDir
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "listen":
+			a.Listen = f.Listen
+		case "in-dir":
+			a.InDir = f.InDir
+		case "out-dir":
+			a.OutDir = f.OutDir
+		case "target":
+			a.Target = f.Target
+		case "max-file-size":
+			a.MaxFileSize = f.MaxFileSize
+		case "max-batch-size":
+			a.MaxBatchSize = f.MaxBatchSize
+		case "max-batch-files":
+			a.MaxBatchFiles = f.MaxBatchFiles
+		case "rate-limit":
+			a.RateLimitOpt.Rate = f.RateLimitOpt.Rate
+		case "rate-burst":
+			a.RateLimitOpt.Burst = f.RateLimitOpt.Burst
+		}
+	})
+	a.followDirs(in, out)
+}
+
+// followDirs moves the settings that were under the previous input or output
+// directory, the storage and janitor ones, to the current directories.
+func (a *App) followDirs(in, out string) {
+	move := func(dir *string) {
+		switch *dir {
+		case in:
+			*dir = a.InDir
+		case out:
+			*dir = a.OutDir
+		}
+	}
+	move(&a.StorageOpt.Dir)
+	for i := range a.JanitorOpt.Policies {
+		move(&a.JanitorOpt.Policies[i].Dir)
+	}
+}
+
+// policy returns the janitor policy of dir, if any.
+func (a *App) policy(dir string) *janitor.Policy {
+	for i := range a.JanitorOpt.Policies {
+		if a.JanitorOpt.Policies[i].Dir == dir {
+			return &a.JanitorOpt.Policies[i]
+		}
+	}
+	return nil
+}
+
+// validate returns every invalid setting of a.
+func (a *App) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	_, _, err := net.SplitHostPort(a.Listen)
+	check(err == nil, "listen: invalid address %q", a.Listen)
+	_, err = clientip.NewResolver(a.TrustedProxies)
+	check(err == nil, "trustedProxies: %v", err)
+	check(a.InDir != "", "inDir: must be set")
+	check(a.OutDir != "", "outDir: must be set")
+	check(oneOf(a.Target, "jpg", "jpeg", "png", "webp"), "target: unsupported format %q", a.Target)
+
+	check(a.JpegOpt.Quality >= 0 && a.JpegOpt.Quality <= 100, "jpegOpt.quality: must be between 0 and 100")
+	check(a.PngOpt.Quality >= 0 && a.PngOpt.Quality <= 100, "pngOpt.quality: must be between 0 and 100")
+	check(a.WebpOpt.Quality >= 0 && a.WebpOpt.Quality <= 100, "webpOpt.quality: must be between 0 and 100")
+	check(a.JpegOpt.Timeout > 0, "jpegOpt.timeout: must be positive")
+	check(a.PngOpt.Timeout > 0, "pngOpt.timeout: must be positive")
+	check(a.WebpOpt.Timeout > 0, "webpOpt.timeout: must be positive")
+
+	check(a.PoolOpt.MaxWorkers > 0, "poolOpt.maxWorkers: must be positive")
+	check(a.PoolOpt.QueueDepth >= 0, "poolOpt.queueDepth: must not be negative")
+	for encoder, n := range a.PoolOpt.PerEncoder {
+		check(n > 0, "poolOpt.perEncoder.%s: must be positive", encoder)
+	}
+
+	check(oneOf(a.StorageOpt.Backend, "", "local", "s3"), "storageOpt.backend: unknown backend %q", a.StorageOpt.Backend)
+	check(a.StorageOpt.Backend != "s3" || a.StorageOpt.Bucket != "", "storageOpt.bucket: must be set for s3")
+	check(a.StorageOpt.PresignExpiry >= 0, "storageOpt.presignExpiry: must not be negative")
+	check(a.JanitorOpt.Interval > 0, "janitorOpt.interval: must be positive")
+	for _, p := range a.JanitorOpt.Policies {
+		check(p.Dir != "", "janitorOpt.policies: dir must be set")
+		check(p.TTL >= 0 && p.MaxBytes >= 0, "janitorOpt.policies: %s: limits must not be negative", p.Dir)
+	}
+	check(oneOf(a.CacheOpt.Backend, "", "memory", "redis"), "cacheOpt.backend: unknown backend %q", a.CacheOpt.Backend)
+	check(a.CacheOpt.Backend != "redis" || a.RedisUrl != "", "cacheOpt.backend: redis needs REDIS_URL")
+	check(a.CacheOpt.TTL >= 0, "cacheOpt.ttl: must not be negative")
+	check(a.CacheOpt.MaxEntries >= 0, "cacheOpt.maxEntries: must not be negative")
+	check(oneOf(a.StatOpt.Backend, "", "file", "redis", "none"), "statOpt.backend: unknown backend %q", a.StatOpt.Backend)
+	check(a.StatOpt.Backend != "redis" || a.RedisUrl != "", "statOpt.backend: redis needs REDIS_URL")
+	check(a.StatOpt.FlushInterval > 0, "statOpt.flushInterval: must be positive")
+	check(oneOf(a.TraceOpt.Exporter, "", "none", "stdout", "otlp"), "traceOpt.exporter: unknown exporter %q", a.TraceOpt.Exporter)
+	check(a.TraceOpt.SampleRatio >= 0 && a.TraceOpt.SampleRatio <= 1, "traceOpt.sampleRatio: must be between 0 and 1")
+
+	check(a.MaxFileSize > 0, "maxFileSize: must be positive")
+	check(a.MaxBatchSize >= a.MaxFileSize, "maxBatchSize: must be at least maxFileSize")
+	check(a.MaxBatchFiles > 0, "maxBatchFiles: must be positive")
+	check(a.WebhookOpt.MaxAttempts > 0, "webhookOpt.maxAttempts: must be positive")
+
+	check(oneOf(a.RateLimitOpt.Backend, "", "memory", "redis"), "rateLimitOpt.backend: unknown backend %q", a.RateLimitOpt.Backend)
+	check(a.RateLimitOpt.Backend != "redis" || a.RedisUrl != "", "rateLimitOpt.backend: redis needs REDIS_URL")
+	check(a.RateLimitOpt.Rate > 0, "rateLimitOpt.rate: must be positive")
+	check(a.RateLimitOpt.Burst > 0, "rateLimitOpt.burst: must be positive")
+	for name, p := range a.Presets {
+		check(p != nil, "presets.%s: must not be empty", name)
+		if p == nil {
+			continue
+		}
+		for _, format := range p.Formats {
+			check(oneOf(format, "jpg", "jpeg", "png", "webp"), "presets.%s.formats: unsupported format %q", name, format)
+		}
+		check(p.Quality >= 0 && p.Quality <= 100, "presets.%s.quality: must be between 0 and 100", name)
+		check(p.Width >= 0 && p.Height >= 0, "presets.%s: width and height must not be negative", name)
+		check(oneOf(p.Metadata, "", "strip", "keep"), "presets.%s.metadata: must be strip or keep", name)
+		check(p.MaxFileSize >= 0, "presets.%s.maxFileSize: must not be negative", name)
+	}
+	for tool, path := range a.Tools {
+		_, err := exec.LookPath(path)
+		check(err == nil, "tools.%s: %v", tool, err)
+	}
+	return errors.Join(errs...)
+}
+
+// makeDirs creates the input and output directories.
+func (a *App) makeDirs() error {
+	for _, dir := range []string{a.InDir, a.OutDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return fmt.Errorf("creating directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// Print writes the configuration as a TOML file that Load accepts, headed by
+// the path of the file it was loaded from. Secrets are redacted.
+func (c *Config) Print(w io.Writer) error {
+	file := c.File
+	if file == "" {
+		file = "none"
+	}
+	if _, err := fmt.Fprintf(w, "# config file: %s\n", file); err != nil {
+		return err
+	}
+	a := *c.App
+	s := *a.StorageOpt
+	for _, key := range []*string{&s.AccessKey, &s.SecretKey, &a.WebhookSecret, &a.TgBotToken} {
+		if *key != "" {
+			*key = "REDACTED"
+		}
+	}
+	a.StorageOpt = &s
+	if u, err := url.Parse(a.RedisUrl); err == nil {
+		a.RedisUrl = u.Redacted()
+	} else if a.RedisUrl != "" {
+		a.RedisUrl = "REDACTED"
+	}
+	return toml.NewEncoder(w).Encode(a)
+}
+
+func oneOf(v string, values ...string) bool {
+	for _, value := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// env reads the environment variables into the settings and collects the
+// errors of the ones that can't be parsed. Unset variables leave the
+// settings unchanged.
+type env struct {
+	errs []error
+}
+
+func (e *env) fail(name, v, want string) {
+	e.errs = append(e.errs, fmt.Errorf("%s: invalid %s %q", name, want, v))
+}
+
+func (e *env) string(dst *string, name string) {
+	if v := os.Getenv(name); v != "" {
+		*dst = v
+	}
+}
+
+// list sets the items of a comma separated list.
+func (e *env) list(dst *[]string, name string) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	*dst = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*dst = append(*dst, item)
+		}
+	}
+}
+
+func (e *env) bool(dst *bool, name string) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(name, v, "boolean")
+		return
+	}
+	*dst = b
+}
+
+func (e *env) int(dst *int, name string) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.fail(name, v, "number")
+		return
+	}
+	*dst = n
+}
+
+func (e *env) int64(dst *int64, name string) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		e.fail(name, v, "number")
+		return
+	}
+	*dst = n
+}
+
+func (e *env) float(dst *float64, name string) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.fail(name, v, "number")
+		return
+	}
+	*dst = f
+}
+
+func (e *env) duration(dst *time.Duration, name string) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail(name, v, "duration")
+		return
+	}
+	*dst = d
+}
+
+// pairs calls set with the key=value pairs of a comma separated list. set
+// returns false for invalid values.
+func (e *env) pairs(name string, set func(key, value string) bool) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	for _, pair := range strings.Split(v, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !set(key, value) {
+			e.fail(name, pair, "pair")
+		}
+	}
+}
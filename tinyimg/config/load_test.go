@@ -0,0 +1,105 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func load(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	return Load(flag.NewFlagSet("test", flag.ContinueOnError), args)
+}
+
+func TestLoadLayers(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	file := filepath.Join(home, "config.toml")
+	if err := os.WriteFile(file, []byte("listen = \":9000\"\ntarget = \"png\"\nmaxBatchFiles = 7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the environment is read by Load, not when the package is initialized
+	t.Setenv("LISTEN_ADDR", ":9001")
+	t.Setenv("RATE_LIMIT", "2.5")
+	t.Setenv("REDIS_URL", "redis://redis:6379/0")
+
+	c, err := load(t, "--config", file, "--listen", ":9002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := c.App
+	if a.Listen != ":9002" || a.Target != "png" || a.MaxBatchFiles != 7 || a.RateLimitOpt.Rate != 2.5 {
+		t.Fatalf("listen %s, target %s, maxBatchFiles %d, rate %v", a.Listen, a.Target, a.MaxBatchFiles, a.RateLimitOpt.Rate)
+	}
+	if a.RedisUrl != "redis://redis:6379/0" || c.File != file {
+		t.Fatalf("redisUrl %s, file %s", a.RedisUrl, c.File)
+	}
+	if a.InDir != filepath.Join(home, "tinyimg", "input") {
+		t.Fatalf("inDir %s", a.InDir)
+	}
+}
+
+func TestLoadInvalidEnv(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("RATE_LIMIT", "fast")
+	t.Setenv("JANITOR_INTERVAL", "10")
+	_, err := load(t)
+	if err == nil {
+		t.Fatal("loaded an invalid environment")
+	}
+	for _, name := range []string{"RATE_LIMIT", "JANITOR_INTERVAL"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not name %s", err, name)
+		}
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("REDIS_URL", "redis://:hunter2@redis:6379/0")
+	t.Setenv("WEBHOOK_SECRET", "webhook-secret")
+	t.Setenv("S3_SECRET_KEY", "s3-secret")
+	c, err := load(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = c.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	printed := out.String()
+	for _, secret := range []string{"hunter2", "webhook-secret", "s3-secret"} {
+		if strings.Contains(printed, secret) {
+			t.Errorf("printed secret %s", secret)
+		}
+	}
+	for _, want := range []string{"# config file: none", "RedisUrl = \"redis://:xxxxx@redis:6379/0\"", "WebhookSecret = \"REDACTED\""} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("printed config is missing %s", want)
+		}
+	}
+}
+
+func TestRedisBackendsNeedRedisUrl(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("RATE_LIMIT_BACKEND", "redis")
+	t.Setenv("CACHE_BACKEND", "redis")
+	t.Setenv("STATS_BACKEND", "redis")
+	_, err := load(t)
+	if err == nil {
+		t.Fatal("loaded redis backends without REDIS_URL")
+	}
+	for _, setting := range []string{"rateLimitOpt.backend", "cacheOpt.backend", "statOpt.backend"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("error %q does not name %s", err, setting)
+		}
+	}
+
+	t.Setenv("REDIS_URL", "redis://redis:6379/0")
+	if _, err = load(t); err != nil {
+		t.Fatal(err)
+	}
+}
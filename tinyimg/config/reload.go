@@ -0,0 +1,128 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	reloadMu sync.Mutex
+	// rebuild builds the settings again the way Load did.
+	rebuild func() (*App, error)
+	// watchedFile is the configuration file given to Load, if any.
+	watchedFile string
+)
+
+// Reload rebuilds the configuration from the file and flags given to Load
+// and swaps in its reloadable settings: the encoder defaults, the presets,
+// the rate limits, the allowed origins, the trusted proxies, the size limits
+// and the tool paths. Other settings need a restart; changes to them are
+// logged and ignored. When the new configuration is invalid the current one
+// is kept.
+func Reload() (*Config, error) {
+	reloadMu.Lock()
+	build := rebuild
+	reloadMu.Unlock()
+	if build == nil {
+		return nil, errors.New("config was not loaded")
+	}
+	a, err := build()
+	if err != nil {
+		return nil, err
+	}
+	return swap(a), nil
+}
+
+// swap makes the reloadable settings of a current. The current settings
+// are read under reloadMu, so concurrent swaps don't lose each other's
+// changes.
+func swap(a *App) *Config {
+	// load the defaults first if Load wasn't called, it takes reloadMu
+	GetConfig()
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	old := current.Load()
+	app := *old.App
+	app.Target = a.Target
+	app.JpegOpt = a.JpegOpt
+	app.PngOpt = a.PngOpt
+	app.WebpOpt = a.WebpOpt
+	// the limiter backend is only chosen at startup
+	rateLimit := *a.RateLimitOpt
+	rateLimit.Backend, rateLimit.RedisPrefix = old.App.RateLimitOpt.Backend, old.App.RateLimitOpt.RedisPrefix
+	app.RateLimitOpt = &rateLimit
+	app.AllowedOrigins = a.AllowedOrigins
+	app.TrustedProxies = a.TrustedProxies
+	app.MaxFileSize = a.MaxFileSize
+	app.MaxBatchSize = a.MaxBatchSize
+	app.MaxBatchFiles = a.MaxBatchFiles
+	app.Presets = a.Presets
+	app.Tools = a.Tools
+
+	c := &Config{App: &app, File: old.File}
+	next := (&Config{App: a}).GetAppConfig()
+	for key, value := range c.GetAppConfig() {
+		if !reflect.DeepEqual(value, next[key]) {
+			slog.Warn("Setting changed, restart to apply it", "setting", key)
+		}
+	}
+	current.Store(c)
+	return c
+}
+
+// Watch reloads the configuration when the process receives SIGHUP or when
+// the configuration file changes, checked every interval, until ctx is done.
+// onReload is called with every new configuration.
+func Watch(ctx context.Context, interval time.Duration, onReload func(*Config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	reloadMu.Lock()
+	file := watchedFile
+	reloadMu.Unlock()
+	modTime := func() time.Time {
+		if file == "" {
+			return time.Time{}
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	lastMod := modTime()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Reloading configuration", "reason", "SIGHUP")
+		case <-ticker.C:
+			mod := modTime()
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			slog.Info("Reloading configuration", "reason", "file changed", "file", file)
+		}
+		c, err := Reload()
+		if err != nil {
+			slog.Error("Invalid configuration, keeping the current one", "err", err)
+			continue
+		}
+		if onReload != nil {
+			onReload(c)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	file := filepath.Join(home, "config.toml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("listen = \":9000\"\ntarget = \"png\"\n")
+	if _, err := load(t, "--config", file); err != nil {
+		t.Fatal(err)
+	}
+
+	write("listen = \":9001\"\ntarget = \"jpg\"\n")
+	c, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the target is reloadable, the listen address needs a restart
+	if c.App.Target != "jpg" || c.App.Listen != ":9000" || c.File != file {
+		t.Fatalf("target %s, listen %s, file %s", c.App.Target, c.App.Listen, c.File)
+	}
+	if GetConfig() != c {
+		t.Fatal("the reloaded config is not current")
+	}
+
+	write("target = \"gif\"\n")
+	if _, err = Reload(); err == nil {
+		t.Fatal("reloaded an invalid config")
+	}
+	if GetConfig() != c {
+		t.Fatal("an invalid config replaced the current one")
+	}
+}
+
+func TestConcurrentReload(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	file := filepath.Join(home, "config.toml")
+	if err := os.WriteFile(file, []byte("target = \"png\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(t, "--config", file); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := Reload(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := GetConfig().RestoreDefaults(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if target := GetConfig().App.Target; target != "png" && target != "webp" {
+		t.Fatalf("target %s", target)
+	}
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/dunkbing/tinyimg/tinyimg/config"
+	"github.com/dunkbing/tinyimg/tinyimg/image"
+	"net/http"
+	"sync"
+)
+
+// batchResult is the outcome of one image of a batch upload.
+type batchResult struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	jobState
+}
+
+// batchSummary aggregates the results of a batch upload. Files of which
+// only some formats were converted are partial, neither succeeded nor
+// failed.
+type batchSummary struct {
+	Files        int   `json:"files"`
+	Succeeded    int   `json:"succeeded"`
+	Partial      int   `json:"partial"`
+	Failed       int   `json:"failed"`
+	OriginalSize int64 `json:"originalSize"`
+	NewSize      int64 `json:"newSize"`
+	SavedBytes   int64 `json:"savedBytes"`
+}
+
+// batchResponse is the response to a batch upload and the payload of every
+// callback. Token downloads every converted file of the batch as one zip
+// archive; callbacks of single images have none.
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+	Summary batchSummary  `json:"summary"`
+	Token   string        `json:"token,omitempty"`
+}
+
+// summarize returns the response to a batch of the given results, without
+// its token.
+func summarize(results []batchResult) batchResponse {
+	res := batchResponse{Results: results}
+	for _, result := range results {
+		res.Summary.Files++
+		switch {
+		case result.Status != image.JobDone:
+			res.Summary.Failed++
+		case len(result.Errors) > 0:
+			res.Summary.Partial++
+		default:
+			res.Summary.Succeeded++
+		}
+		res.Summary.OriginalSize += result.Size
+		for _, d := range result.Data {
+			res.Summary.NewSize += d.NewSize
+			res.Summary.SavedBytes += d.SavedBytes
+		}
+	}
+	return res
+}
+
+// outputs returns the names of the converted files of the formats that
+// succeeded. Files and Data are in the order of the formats and the Data of
+// a failed format is empty.
+func (r batchResult) outputs() []string {
+	var files []string
+	for i, file := range r.Files {
+		if i < len(r.Data) && r.Data[i].Format != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// jobCallback returns the callback payload of a finished job: a batch of
+// its one image.
+func jobCallback(job *image.Job) batchResponse {
+	return summarize([]batchResult{{
+		Name:     job.File.Name,
+		Size:     job.File.Size,
+		jobState: newJobState(job.State()),
+	}})
+}
+
+// uploadBatch converts the images of a batch concurrently and answers with
+// per-file results, a summary and a token to download every output.
+func (h *handler) uploadBatch(w http.ResponseWriter, r *http.Request, uploads []upload, preset *config.Preset, callbackUrl string) {
+	formats := readFormats(r)
+	results := make([]batchResult, len(uploads))
+
+	// convert a few files at a time so a large batch doesn't overflow the
+	// encoder queue
+	sem := make(chan struct{}, max(h.app().PoolOpt.MaxWorkers, 1))
+	var wg sync.WaitGroup
+	for i, u := range uploads {
+		wg.Add(1)
+		go func(i int, u upload) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = h.convertUpload(r, u, formats, preset)
+		}(i, u)
+	}
+	wg.Wait()
+
+	res := summarize(results)
+	var (
+		files   []string
+		details []formatError
+	)
+	// identical images or formats of the batch share their outputs
+	seen := make(map[string]bool)
+	for _, result := range results {
+		details = append(details, result.Errors...)
+		for _, file := range result.outputs() {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	res.Token = h.fileManager.AddBatch(files)
+
+	if callbackUrl != "" {
+		h.notify(callbackUrl, res)
+	}
+	// like a single upload, a batch is a partial success when some of its
+	// files or formats failed and a failure when none succeeded
+	h.setRetryAfter(w, details)
+	status := http.StatusOK
+	switch {
+	case res.Summary.Succeeded == 0 && res.Summary.Partial == 0:
+		status = conversionError(details).Status
+	case len(details) > 0:
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// convertUpload converts one image of a batch.
+func (h *handler) convertUpload(r *http.Request, u upload, formats []string, preset *config.Preset) batchResult {
+	result := batchResult{Name: u.name, Size: u.size}
+	fail := func(err error) batchResult {
+		result.Status = image.JobFailed
+		result.Errors = formatErrors([]error{fileError(err)})
+		return result
+	}
+	if u.err != nil {
+		u.discard()
+		return fail(u.err)
+	}
+	f, err := h.saveFile(u, formats, preset)
+	if err != nil {
+		return fail(err)
+	}
+	job, err := h.fileManager.HandleFile(r.Context(), f)
+	if err != nil {
+		return fail(err)
+	}
+	job.Convert(r.Context())
+	result.jobState = newJobState(job.State())
+	return result
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dunkbing/tinyimg/tinyimg/image"
+)
+
+func TestSummarize(t *testing.T) {
+	done := func(name string, formats []string, failed ...string) batchResult {
+		r := batchResult{Name: name, Size: 100}
+		r.Status = image.JobDone
+		for _, format := range formats {
+			r.Files = append(r.Files, name+"."+format)
+			if slices.Contains(failed, format) {
+				r.Data = append(r.Data, image.CompressResult{})
+				r.Errors = append(r.Errors, formatErrors([]error{formatErr(format, context.DeadlineExceeded)})...)
+				continue
+			}
+			r.Data = append(r.Data, image.CompressResult{Format: format, NewSize: 40, SavedBytes: 60})
+		}
+		return r
+	}
+	failed := batchResult{Name: "c"}
+	failed.Status = image.JobFailed
+
+	res := summarize([]batchResult{
+		done("a", []string{"png", "webp"}),
+		done("b", []string{"png", "webp"}, "webp"),
+		failed,
+	})
+	want := batchSummary{Files: 3, Succeeded: 1, Partial: 1, Failed: 1, OriginalSize: 200, NewSize: 120, SavedBytes: 180}
+	if res.Summary != want {
+		t.Fatalf("summary %+v, want %+v", res.Summary, want)
+	}
+
+	if outputs := res.Results[1].outputs(); !slices.Equal(outputs, []string{"b.png"}) {
+		t.Fatalf("outputs of a partial file %v", outputs)
+	}
+	if outputs := failed.outputs(); len(outputs) != 0 {
+		t.Fatalf("outputs of a failed file %v", outputs)
+	}
+}
+
+func TestUploadBatchToken(t *testing.T) {
+	h := newTestHandler(t)
+	img, other := testPNG(t, 1), testPNG(t, 2)
+	// the same image twice and a jpg format that always fails
+	r := multipartUpload(t, map[string]string{"formats": "png,webp,jpg"}, img, img, other)
+	w := httptest.NewRecorder()
+	h.Upload(w, r)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var res batchResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if s := res.Summary; s.Files != 3 || s.Partial != 3 || s.Succeeded != 0 || s.Failed != 0 {
+		t.Fatalf("summary %+v", s)
+	}
+
+	files, ok := h.fileManager.GetBatch(res.Token)
+	if !ok {
+		t.Fatal("batch not found")
+	}
+	// two distinct images with two converted formats each
+	if len(files) != 4 {
+		t.Fatalf("batch files %v", files)
+	}
+	seen := map[string]bool{}
+	for _, file := range files {
+		if seen[file] || strings.HasSuffix(file, ".jpg") {
+			t.Fatalf("batch files %v", files)
+		}
+		seen[file] = true
+	}
+}
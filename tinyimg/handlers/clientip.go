@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/dunkbing/tinyimg/tinyimg/clientip"
+	"github.com/dunkbing/tinyimg/tinyimg/config"
+)
+
+// resolver is the clientip.Resolver built from the trusted proxies of app.
+type resolver struct {
+	app *config.App
+	*clientip.Resolver
+}
+
+// ClientIP finds the address of the client of every request, trusting the
+// forwarding headers of the configured proxies, and stores it in the
+// request's context for the limiter and the logs.
+func ClientIP(next http.Handler) http.Handler {
+	var current atomic.Pointer[resolver]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app := config.GetConfig().App
+		res := current.Load()
+		if res == nil || res.app != app {
+			// the trusted proxies may have been reloaded
+			cr, err := clientip.NewResolver(app.TrustedProxies)
+			if err != nil {
+				slog.Error("Invalid trusted proxies", "err", err)
+				cr, _ = clientip.NewResolver(nil)
+			}
+			res = &resolver{app: app, Resolver: cr}
+			current.Store(res)
+		}
+		ctx := clientip.NewContext(r.Context(), res.ClientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
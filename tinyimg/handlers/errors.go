@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/dunkbing/tinyimg/tinyimg/image"
+	"github.com/dunkbing/tinyimg/tinyimg/pool"
+)
+
+// Code identifies an error in API responses. Codes are stable, messages are
+// meant for people and may change.
+type Code string
+
+const (
+	CodeInvalidBody          Code = "invalid_body"
+	CodeNoFile               Code = "no_file"
+	CodeTooManyFiles         Code = "too_many_files"
+	CodeFileTooLarge         Code = "file_too_large"
+	CodeReadFailed           Code = "read_failed"
+	CodeNotImage             Code = "not_image"
+	CodeUnsupportedImage     Code = "unsupported_image"
+	CodeInvalidArchive       Code = "invalid_archive"
+	CodeInvalidUrl           Code = "invalid_url"
+	CodeUrlNotAllowed        Code = "url_not_allowed"
+	CodeTooManyRedirects     Code = "too_many_redirects"
+	CodeFetchFailed          Code = "fetch_failed"
+	CodeCallbacksDisabled    Code = "callbacks_disabled"
+	CodeInvalidCallbackUrl   Code = "invalid_callback_url"
+	CodeInvalidCompression   Code = "invalid_compression"
+	CodeUnknownPreset        Code = "unknown_preset"
+	CodeNotFound             Code = "not_found"
+	CodeUnsupportedMediaType Code = "unsupported_media_type"
+	CodeUnsupportedVersion   Code = "unsupported_version"
+	CodeInvalidHeader        Code = "invalid_header"
+	CodeOffsetMismatch       Code = "offset_mismatch"
+	CodeUploadComplete       Code = "upload_complete"
+	CodeUploadLocked         Code = "upload_locked"
+	CodeRateLimited          Code = "rate_limited"
+	CodeServerBusy           Code = "server_busy"
+
+	// Codes of the formats of a conversion.
+	CodeConversionFailed  Code = "conversion_failed"
+	CodeUnsupportedFormat Code = "unsupported_format"
+	CodeTimeout           Code = "timeout"
+	CodeCanceled          Code = "canceled"
+	CodeStorageFailed     Code = "storage_failed"
+
+	CodeInternal Code = "internal"
+)
+
+// apiError is an error answered to the client. A 4xx Status means the
+// client is at fault, a 5xx one the server.
+type apiError struct {
+	Status  int
+	Code    Code
+	Message string
+	Details []formatError
+}
+
+func newError(status int, code Code, message string) *apiError {
+	return &apiError{Status: status, Code: code, Message: message}
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// formatError is the failure of one output format of a conversion. Format
+// is empty when the whole file failed, before any format was converted.
+type formatError struct {
+	Format  string `json:"format,omitempty"`
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorResponse is the body of every error response.
+type errorResponse struct {
+	Error errorJSON `json:"error"`
+}
+
+type errorJSON struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+	// Type is "client" when the request should not be retried as is and
+	// "server" otherwise.
+	Type    string        `json:"type"`
+	Details []formatError `json:"details,omitempty"`
+}
+
+// writeError answers err as JSON. Errors that are not an *apiError are
+// internal: they are logged and answered with a generic message.
+func writeError(w http.ResponseWriter, err error) {
+	var e *apiError
+	if !errors.As(err, &e) {
+		slog.Error("Internal error", "err", err)
+		e = newError(http.StatusInternalServerError, CodeInternal, "Internal server error")
+	}
+	errorType := "client"
+	if e.Status >= 500 {
+		errorType = "server"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(errorResponse{Error: errorJSON{
+		Code:    e.Code,
+		Message: e.Message,
+		Type:    errorType,
+		Details: e.Details,
+	}})
+}
+
+// fileError maps the errors of preparing an uploaded file for conversion.
+func fileError(err error) error {
+	if errors.Is(err, image.ErrUnsupportedImage) {
+		return newError(http.StatusUnsupportedMediaType, CodeUnsupportedImage, err.Error())
+	}
+	return err
+}
+
+// formatErrors describes the errors of the formats of a conversion. Errors
+// that are neither an *image.FormatError nor an *apiError are internal: they
+// are logged and described with a generic message.
+func formatErrors(errs []error) []formatError {
+	details := make([]formatError, len(errs))
+	for i, err := range errs {
+		details[i] = formatError{Code: formatCode(err), Message: err.Error()}
+		var (
+			fe *image.FormatError
+			ae *apiError
+		)
+		switch {
+		case errors.As(err, &fe):
+			details[i].Format = fe.Format
+			details[i].Message = fe.Err.Error()
+		case errors.As(err, &ae):
+			details[i].Code = ae.Code
+			details[i].Message = ae.Message
+		case details[i].Code == CodeConversionFailed:
+			slog.Error("Internal error", "err", err)
+			details[i].Code = CodeInternal
+			details[i].Message = "Internal server error"
+		}
+		if details[i].Code == CodeStorageFailed {
+			slog.Error("Error storing converted image", "err", err)
+			details[i].Message = "The converted image could not be stored"
+		}
+	}
+	return details
+}
+
+func formatCode(err error) Code {
+	switch {
+	case errors.Is(err, pool.ErrQueueFull):
+		return CodeServerBusy
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, image.ErrUnsupportedFormat):
+		return CodeUnsupportedFormat
+	case errors.Is(err, image.ErrStorage):
+		return CodeStorageFailed
+	default:
+		return CodeConversionFailed
+	}
+}
+
+// serverFault reports whether a format failed because of the server, so
+// converting the same image again may succeed.
+func serverFault(code Code) bool {
+	switch code {
+	case CodeServerBusy, CodeTimeout, CodeCanceled, CodeStorageFailed, CodeInternal:
+		return true
+	default:
+		return false
+	}
+}
+
+// conversionError returns the error answered for a conversion of which
+// every format failed. The image can't be processed when any format failed
+// because of it. Otherwise the server is at fault: it is busy, the encoders
+// timed out or were canceled, or the outputs could not be stored.
+func conversionError(details []formatError) *apiError {
+	codes := make(map[Code]bool)
+	for _, d := range details {
+		if !serverFault(d.Code) {
+			e := newError(http.StatusUnprocessableEntity, CodeConversionFailed, "The image could not be converted")
+			e.Details = details
+			return e
+		}
+		codes[d.Code] = true
+	}
+	var e *apiError
+	switch {
+	case codes[CodeServerBusy]:
+		e = newError(http.StatusServiceUnavailable, CodeServerBusy, "Server is busy, please try again later")
+	case codes[CodeTimeout]:
+		e = newError(http.StatusGatewayTimeout, CodeTimeout, "The conversion timed out")
+	case codes[CodeCanceled]:
+		e = newError(http.StatusServiceUnavailable, CodeCanceled, "The conversion was canceled")
+	case codes[CodeStorageFailed]:
+		e = newError(http.StatusInternalServerError, CodeInternal, "The converted image could not be stored")
+	default:
+		e = newError(http.StatusInternalServerError, CodeInternal, "Internal server error")
+	}
+	e.Details = details
+	return e
+}
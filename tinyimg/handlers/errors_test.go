@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/dunkbing/tinyimg/tinyimg/image"
+	"github.com/dunkbing/tinyimg/tinyimg/pool"
+)
+
+func formatErr(format string, err error) error {
+	return &image.FormatError{Format: format, Err: err}
+}
+
+func TestConversionError(t *testing.T) {
+	tests := []struct {
+		name   string
+		errs   []error
+		status int
+		code   Code
+	}{
+		{"input", []error{formatErr("webp", errors.New("exit status 1"))}, http.StatusUnprocessableEntity, CodeConversionFailed},
+		{"unsupported", []error{formatErr("heic", image.ErrUnsupportedFormat)}, http.StatusUnprocessableEntity, CodeConversionFailed},
+		{"input and timeout", []error{
+			formatErr("webp", errors.New("exit status 1")),
+			formatErr("png", context.DeadlineExceeded),
+		}, http.StatusUnprocessableEntity, CodeConversionFailed},
+		{"busy", []error{formatErr("webp", pool.ErrQueueFull)}, http.StatusServiceUnavailable, CodeServerBusy},
+		{"busy and timeout", []error{
+			formatErr("webp", context.DeadlineExceeded),
+			formatErr("png", pool.ErrQueueFull),
+		}, http.StatusServiceUnavailable, CodeServerBusy},
+		{"timeout", []error{formatErr("webp", context.DeadlineExceeded)}, http.StatusGatewayTimeout, CodeTimeout},
+		{"canceled", []error{formatErr("webp", context.Canceled)}, http.StatusServiceUnavailable, CodeCanceled},
+		{"storage", []error{formatErr("webp", image.ErrStorage)}, http.StatusInternalServerError, CodeInternal},
+		{"rejected file", []error{errNotImage}, http.StatusUnprocessableEntity, CodeConversionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := conversionError(formatErrors(tt.errs))
+			if e.Status != tt.status || e.Code != tt.code {
+				t.Fatalf("got %d %s, want %d %s", e.Status, e.Code, tt.status, tt.code)
+			}
+			if len(e.Details) != len(tt.errs) {
+				t.Fatalf("details %+v", e.Details)
+			}
+		})
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	details := formatErrors([]error{
+		formatErr("webp", pool.ErrQueueFull),
+		errNotImage,
+		errors.New("open /tmp/input/a.png: no such file or directory"),
+	})
+	want := []formatError{
+		{Format: "webp", Code: CodeServerBusy, Message: pool.ErrQueueFull.Error()},
+		{Code: errNotImage.Code, Message: errNotImage.Message},
+		{Code: CodeInternal, Message: "Internal server error"},
+	}
+	for i := range want {
+		if details[i] != want[i] {
+			t.Errorf("details[%d] = %+v, want %+v", i, details[i], want[i])
+		}
+	}
+}
+
+func TestJobStateErrors(t *testing.T) {
+	state := newJobState(image.JobState{
+		ID:     "id",
+		Status: image.JobFailed,
+		Errors: []error{formatErr("webp", context.DeadlineExceeded)},
+	})
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		ID     string        `json:"id"`
+		Errors []formatError `json:"errors"`
+	}
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := formatError{Format: "webp", Code: CodeTimeout, Message: context.DeadlineExceeded.Error()}
+	if got.ID != "id" || len(got.Errors) != 1 || got.Errors[0] != want {
+		t.Fatalf("job state %s", data)
+	}
+}
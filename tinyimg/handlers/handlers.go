@@ -1,22 +1,33 @@
 package handlers
 
 import (
+	"archive/zip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dunkbing/tinyimg/tinyimg/config"
 	"github.com/dunkbing/tinyimg/tinyimg/image"
+	"github.com/dunkbing/tinyimg/tinyimg/storage"
+	"github.com/dunkbing/tinyimg/tinyimg/tracing"
 	"github.com/dunkbing/tinyimg/tinyimg/utils"
+	"github.com/dunkbing/tinyimg/tinyimg/webhook"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type RequestBody struct {
 	Files []string `json:"files"`
+	// Compression is "store" (the default) or "deflate".
+	Compression string `json:"compression"`
 }
 
 func getContentType(fileName string) string {
@@ -50,170 +61,369 @@ func isFileUploaded(filePath string) bool {
 
 type handler struct {
 	fileManager *image.FileManager
-	config      *config.Config
+	webhooks    *webhook.Dispatcher
+	fetcher     *utils.Fetcher
 }
 
-func New() *handler {
+// New creates the handlers of the API. It fails when the FileManager or the
+// webhook dispatcher can't be set up.
+func New() (*handler, error) {
 	c := config.GetConfig()
-	return &handler{
-		fileManager: image.NewFileManager(),
-		config:      c,
+	fileManager, err := image.NewFileManager()
+	if err != nil {
+		return nil, err
 	}
+	webhooks, err := webhook.NewDispatcher(c.App.WebhookDir, c.App.WebhookSecret, c.App.WebhookOpt)
+	if err != nil {
+		return nil, fmt.Errorf("webhook dispatcher: %w", err)
+	}
+	return &handler{
+		fileManager: fileManager,
+		webhooks:    webhooks,
+		fetcher: &utils.Fetcher{
+			MaxRedirects: 5,
+			Timeout:      30 * time.Second,
+		},
+	}, nil
 }
 
+// Storage returns the storage holding the converted images.
+func (h *handler) Storage() storage.Storage {
+	return h.fileManager.Storage()
+}
+
+// FlushStats stores the app stats counted since the last flush. It is
+// called on shutdown, after the last request finished.
+func (h *handler) FlushStats(ctx context.Context) error {
+	return h.fileManager.Stats().Flush(ctx)
+}
+
+// app returns the current settings. They can be reloaded at any time, so
+// they are not kept between requests.
+func (h *handler) app() *config.App {
+	return config.GetConfig().App
+}
+
+// Upload converts the uploaded images. A single image is answered with its
+// results; several file parts or a zip archive are handled as a batch.
 func (h *handler) Upload(w http.ResponseWriter, r *http.Request) {
-	var sizeLimit int64 = 10 * 1024 * 1024
-	r.Body = http.MaxBytesReader(w, r.Body, sizeLimit)
+	ctx, span := tracing.Start(r.Context(), "Upload")
+	defer span.End()
+	r = r.WithContext(ctx)
 
-	startTime := time.Now()
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Error retrieving the file. The file may be too large (max 10MB)", http.StatusInternalServerError)
+	if h.fileManager.Busy() {
+		h.serverBusy(w)
 		return
 	}
-	defer file.Close()
 
-	data, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, "Error reading the file", http.StatusInternalServerError)
+	uploads, ok := h.readUploads(w, r)
+	if !ok {
 		return
 	}
-
-	mimeType := http.DetectContentType(data)
-	if !isImage(mimeType) {
-		http.Error(w, "Invalid file format. Only images are allowed.", http.StatusBadRequest)
+	span.SetAttributes(attribute.Int("uploads", len(uploads)))
+	callbackUrl, ok := h.readCallbackUrl(w, r)
+	if !ok {
+		discardAll(uploads)
 		return
 	}
-	fileType, _ := image.GetFileType(mimeType)
-	filename, err := utils.GenerateHash(fmt.Sprintf("%s-%v", header.Filename, header.Size))
+	preset, err := h.readPreset(r)
 	if err != nil {
-		slog.Error("Error generating file name", "err", err.Error())
-		filename = filepath.Base(header.Filename)
-	}
-	ext := fmt.Sprintf(".%s", fileType)
-	filename = fmt.Sprintf("%s%s", filename, ext)
-
-	dest := filepath.Join(h.config.App.InDir, filename)
-	if !isFileUploaded(dest) {
-		slog.Info("Upload", "dest", dest)
-		err = os.WriteFile(dest, data, 0644)
-		if err != nil {
-			http.Error(w, "Error writing the file", http.StatusInternalServerError)
-			return
-		}
+		discardAll(uploads)
+		writeError(w, err)
+		return
 	}
-	took := time.Since(startTime).Seconds()
-	fmt.Println("Write to file took", took, "seconds")
-
-	formatStr := r.FormValue("formats")
-	formats := make([]string, 0)
-	if formatStr != "" {
-		formats = strings.Split(formatStr, ",")
-	} else {
-		formats = append(formats, fileType)
+	if len(uploads) > 1 || uploads[0].fromArchive {
+		h.uploadBatch(w, r, uploads, preset, callbackUrl)
+		return
 	}
-
-	f := image.File{
-		Data:          data,
-		Ext:           ext,
-		MimeType:      mimeType,
-		Name:          filename,
-		Size:          header.Size,
-		Formats:       formats,
-		InputFileDest: dest,
+	if uploads[0].err != nil {
+		writeError(w, uploads[0].err)
+		return
+	}
+	f, err := h.saveFile(uploads[0], readFormats(r), preset)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 
-	err = h.fileManager.HandleFile(&f)
+	job, err := h.fileManager.HandleFile(r.Context(), f)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, fileError(err))
 		return
 	}
-	results, files, errs := h.fileManager.Convert()
-	strErrs := make([]string, len(errs))
-	for i, err := range errs {
-		strErrs[i] = err.Error()
+	results, files, errs := job.Convert(r.Context())
+	if callbackUrl != "" {
+		h.notify(callbackUrl, jobCallback(job))
 	}
 
-	// Success
+	// Some formats failing is a partial success, all of them a failure.
+	details := formatErrors(errs)
+	h.setRetryAfter(w, details)
+	status := http.StatusOK
+	switch {
+	case len(errs) > 0 && len(errs) == len(files):
+		writeError(w, conversionError(details))
+		return
+	case len(errs) > 0:
+		status = http.StatusMultiStatus
+	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(map[string]any{
 		"data":   results,
 		"files":  files,
-		"errors": strErrs,
+		"errors": details,
 	})
 }
 
+// readFile reads the single uploaded image of a request and saves it to the
+// input directory. It writes the error response and returns false on failure.
+func (h *handler) readFile(w http.ResponseWriter, r *http.Request) (*image.File, bool) {
+	uploads, ok := h.readUploads(w, r)
+	if !ok {
+		return nil, false
+	}
+	if len(uploads) != 1 || uploads[0].fromArchive {
+		discardAll(uploads)
+		writeError(w, newError(http.StatusBadRequest, CodeTooManyFiles, "Exactly one image is expected"))
+		return nil, false
+	}
+	if uploads[0].err != nil {
+		writeError(w, uploads[0].err)
+		return nil, false
+	}
+	preset, err := h.readPreset(r)
+	if err != nil {
+		uploads[0].discard()
+		writeError(w, err)
+		return nil, false
+	}
+
+	f, err := h.saveFile(uploads[0], readFormats(r), preset)
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	return f, true
+}
+
+// readPreset returns the preset named in the optional preset field.
+func (h *handler) readPreset(r *http.Request) (*config.Preset, error) {
+	return h.lookupPreset(r.FormValue("preset"))
+}
+
+// lookupPreset returns the preset called name, or nil when name is empty.
+func (h *handler) lookupPreset(name string) (*config.Preset, error) {
+	if name == "" {
+		return nil, nil
+	}
+	preset, ok := h.app().Presets[name]
+	if !ok {
+		return nil, newError(http.StatusBadRequest, CodeUnknownPreset, fmt.Sprintf("Unknown preset %q", name))
+	}
+	return preset, nil
+}
+
+// readCallbackUrl returns the optional callbackUrl field of a request. It
+// writes the error response and returns false when the URL is invalid or
+// callbacks are disabled.
+func (h *handler) readCallbackUrl(w http.ResponseWriter, r *http.Request) (string, bool) {
+	callbackUrl := r.FormValue("callbackUrl")
+	if callbackUrl == "" {
+		return "", true
+	}
+	return callbackUrl, h.validCallbackUrl(w, r, callbackUrl)
+}
+
+// validCallbackUrl checks a callback URL can be used. It writes the error
+// response and returns false otherwise.
+func (h *handler) validCallbackUrl(w http.ResponseWriter, r *http.Request, callbackUrl string) bool {
+	if !h.webhooks.Enabled() {
+		writeError(w, newError(http.StatusBadRequest, CodeCallbacksDisabled, "Callbacks are not enabled on this server"))
+		return false
+	}
+	err := h.webhooks.CheckURL(r.Context(), callbackUrl)
+	switch {
+	case errors.Is(err, utils.ErrBlockedAddress):
+		writeError(w, newError(http.StatusBadRequest, CodeUrlNotAllowed, "The callback URL points to an address that is not allowed"))
+		return false
+	case err != nil:
+		writeError(w, newError(http.StatusBadRequest, CodeInvalidCallbackUrl, "Invalid callback URL"))
+		return false
+	}
+	return true
+}
+
+// notify posts the results of a finished conversion to its callback URL.
+// Every callback has the shape of a batch response, so single uploads and
+// jobs post a batch of one.
+func (h *handler) notify(callbackUrl string, payload batchResponse) {
+	if err := h.webhooks.Enqueue(callbackUrl, payload); err != nil {
+		slog.Error("Error enqueuing webhook", "url", callbackUrl, "err", err)
+	}
+}
+
+// serverBusy tells the client to retry later because the encoder pool is full.
+func (h *handler) serverBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(h.fileManager.RetryAfter()))
+	writeError(w, newError(http.StatusServiceUnavailable, CodeServerBusy, "Server is busy, please try again later"))
+}
+
+// setRetryAfter tells the client when to retry the formats that failed
+// because the encoder pool was full.
+func (h *handler) setRetryAfter(w http.ResponseWriter, details []formatError) {
+	for _, d := range details {
+		if d.Code == CodeServerBusy {
+			w.Header().Set("Retry-After", strconv.Itoa(h.fileManager.RetryAfter()))
+			return
+		}
+	}
+}
+
+// Stats returns the app stats with their breakdowns by format, encoder and
+// time.
+func (h *handler) Stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.fileManager.Stats().Report(time.Now()))
+}
+
+// Presets lists the encoding presets that can be selected on upload.
+func (h *handler) Presets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.app().Presets)
+}
+
 func (h *handler) DownloadAll(w http.ResponseWriter, r *http.Request) {
 	var body RequestBody
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
-		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+		writeError(w, newError(http.StatusBadRequest, CodeInvalidBody, "Error parsing request body"))
 		return
 	}
+	if body.Compression == "" {
+		body.Compression = r.URL.Query().Get("compression")
+	}
 
-	zippedPath, err := h.fileManager.ZipFiles(body.Files)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	h.serveZip(w, r, body.Files, body.Compression)
+}
+
+// DownloadBatch serves the outputs of a batch upload as a zip archive.
+func (h *handler) DownloadBatch(w http.ResponseWriter, r *http.Request) {
+	files, ok := h.fileManager.GetBatch(r.PathValue("token"))
+	if !ok {
+		writeError(w, newError(http.StatusNotFound, CodeNotFound, "Batch not found"))
 		return
 	}
-	zipFileName := filepath.Base(zippedPath)
-	zipFile, err := os.Open(zippedPath)
-	if err != nil {
-		http.Error(w, "Error opening zip file", http.StatusInternalServerError)
+	h.serveZip(w, r, files, r.URL.Query().Get("compression"))
+}
+
+// zipMethod returns the zip method for a compression name. Converted images
+// are already compressed, so they are stored unless deflate is asked for.
+func zipMethod(compression string) (uint16, bool) {
+	switch compression {
+	case "", "store":
+		return zip.Store, true
+	case "deflate":
+		return zip.Deflate, true
+	default:
+		return 0, false
+	}
+}
+
+// serveZip streams a zip archive of the given output files. Files that are
+// no longer stored are listed in the X-Missing-Files header and the
+// archive's manifest.json; if none are left the response is a 404.
+func (h *handler) serveZip(w http.ResponseWriter, r *http.Request, files []string, compression string) {
+	method, ok := zipMethod(compression)
+	if !ok {
+		writeError(w, newError(http.StatusBadRequest, CodeInvalidCompression, "Compression must be store or deflate"))
+		return
+	}
+	if len(files) == 0 {
+		writeError(w, newError(http.StatusBadRequest, CodeNoFile, "No files to download"))
 		return
 	}
-	defer zipFile.Close()
 
+	missing := h.fileManager.MissingFiles(r.Context(), files)
+	if len(missing) == len(files) {
+		writeError(w, newError(http.StatusNotFound, CodeNotFound, "Files not found: "+strings.Join(missing, ", ")))
+		return
+	}
+	if len(missing) > 0 {
+		w.Header().Set("X-Missing-Files", strings.Join(missing, ","))
+	}
 	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", zipFileName))
-	_, err = io.Copy(w, zipFile)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", image.ZipName(files)))
+
+	// the status is sent with the first bytes, errors can only be logged
+	_, err := h.fileManager.ZipFiles(r.Context(), w, files, method)
 	if err != nil {
-		http.Error(w, "Error serving zip file", http.StatusInternalServerError)
-		return
+		slog.Error("Error streaming zip file", "err", err)
 	}
 }
 
+// ServeImg serves a converted image. When the storage can presign URLs and
+// storageOpt.presignExpiry is set, clients are redirected to download it
+// from the storage directly.
 func (h *handler) ServeImg(w http.ResponseWriter, r *http.Request) {
 	fileName := r.URL.Query().Get("f")
 	if fileName == "" {
-		http.Error(w, "File not found", http.StatusBadRequest)
+		writeError(w, newError(http.StatusBadRequest, CodeNoFile, "No file was given"))
 		return
 	}
-
-	filePath := filepath.Join(h.config.App.OutDir, fileName)
-
-	_, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+	if expiry := h.app().StorageOpt.PresignExpiry; expiry > 0 && h.redirectImg(w, r, fileName, expiry) {
 		return
 	}
 
-	file, err := os.Open(filePath)
+	file, info, err := h.fileManager.Storage().Get(r.Context(), fileName)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+		writeError(w, newError(http.StatusNotFound, CodeNotFound, "File not found"))
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 	defer file.Close()
 
 	contentType := getContentType(fileName)
 	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
 
-	_, err = io.Copy(w, file)
+	// the status is sent with the first bytes, errors can only be logged
+	if _, err = io.Copy(w, file); err != nil {
+		slog.Info("Error serving file", "file", fileName, "err", err)
+	}
+}
+
+// redirectImg redirects the client to a presigned URL of fileName. It
+// returns false, having written nothing, when the image should be served by
+// the application instead.
+func (h *handler) redirectImg(w http.ResponseWriter, r *http.Request, fileName string, expiry time.Duration) bool {
+	store := h.fileManager.Storage()
+	// presigning doesn't check the object exists
+	if _, err := store.Stat(r.Context(), fileName); err != nil {
+		return false
+	}
+	u, err := store.Presign(r.Context(), fileName, expiry)
 	if err != nil {
-		http.Error(w, "Error serving file", http.StatusInternalServerError)
-		return
+		if !errors.Is(err, storage.ErrPresignUnsupported) {
+			slog.Error("Error presigning image url", "file", fileName, "err", err)
+		}
+		return false
 	}
+	http.Redirect(w, r, u, http.StatusFound)
+	return true
 }
 
 func (h *handler) ServeVideo(w http.ResponseWriter, r *http.Request) {
 	fileName := r.URL.Query().Get("f")
 	if fileName == "" {
-		http.Error(w, "File not found", http.StatusBadRequest)
+		writeError(w, newError(http.StatusBadRequest, CodeNoFile, "No file was given"))
 		return
 	}
 
-	videoPath := filepath.Join(h.config.App.OutDir, fileName)
+	videoPath := filepath.Join(h.app().OutDir, fileName)
 	ext := strings.ToLower(filepath.Ext(videoPath))
 
 	var contentType string
@@ -233,7 +443,7 @@ func (h *handler) ServeVideo(w http.ResponseWriter, r *http.Request) {
 	case ".zip":
 		contentType = "application/zip"
 	default:
-		http.Error(w, "Unsupported video format", http.StatusUnsupportedMediaType)
+		writeError(w, newError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Unsupported video format"))
 		return
 	}
 	w.Header().Set("Content-Type", contentType)
@@ -241,14 +451,12 @@ func (h *handler) ServeVideo(w http.ResponseWriter, r *http.Request) {
 
 	file, err := os.Open(videoPath)
 	if err != nil {
-		http.Error(w, "File not found", http.StatusNotFound)
+		writeError(w, newError(http.StatusNotFound, CodeNotFound, "File not found"))
 		return
 	}
 	defer file.Close()
 
-	_, err = io.Copy(w, file)
-	if err != nil {
-		http.Error(w, "Error serving video", http.StatusInternalServerError)
-		return
+	if _, err = io.Copy(w, file); err != nil {
+		slog.Info("Error serving video", "file", fileName, "err", err)
 	}
 }
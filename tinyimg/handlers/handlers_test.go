@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dunkbing/tinyimg/tinyimg/config"
+	"github.com/dunkbing/tinyimg/tinyimg/utils"
+)
+
+// fakeEncoder stands in for pngquant and cwebp: it copies its input to the
+// file given by -o or --output.
+const fakeEncoder = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-o|--output) out="$2"; shift ;;
+	-*) ;;
+	*) in="$1" ;;
+	esac
+	shift
+done
+cp "$in" "$out"
+`
+
+// failingEncoder stands in for jpegoptim, so jpg outputs always fail.
+const failingEncoder = "#!/bin/sh\nexit 1\n"
+
+func TestMain(m *testing.M) {
+	home, err := os.MkdirTemp("", "tinyimg-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// the default directories are under the home directory
+	os.Setenv("HOME", home)
+	file := filepath.Join(home, "config.toml")
+	if err = os.WriteFile(file, []byte("[poolOpt]\nqueueDepth = 1024\n"), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err = config.Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"--config", file}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// newTestHandler returns the handlers with fake encoders.
+func newTestHandler(t *testing.T) *handler {
+	t.Helper()
+	dir := t.TempDir()
+	tools := map[string]string{}
+	for tool, script := range map[string]string{"pngquant": fakeEncoder, "cwebp": fakeEncoder, "jpegoptim": failingEncoder} {
+		path := filepath.Join(dir, tool)
+		if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		tools[tool] = path
+	}
+	utils.SetToolPaths(tools)
+	t.Cleanup(func() { utils.SetToolPaths(nil) })
+	h, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// testPNG returns a distinct 4x4 PNG for n.
+func testPNG(t *testing.T, n int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(0, 0, color.RGBA{R: uint8(n), G: uint8(n >> 8), B: 2, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// multipartUpload returns a multipart upload of files with the given fields.
+func multipartUpload(t *testing.T, fields map[string]string, files ...[]byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	for i, file := range files {
+		fw, err := mw.CreateFormFile("file", fmt.Sprintf("image%d.png", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(file)
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/dunkbing/tinyimg/tinyimg/image"
+)
+
+// jobState is the state of a job returned to clients. Its errors are
+// described like the ones of an upload.
+type jobState struct {
+	image.JobState
+	Errors []formatError `json:"errors"`
+}
+
+func newJobState(s image.JobState) jobState {
+	return jobState{JobState: s, Errors: formatErrors(s.Errors)}
+}
+
+// CreateJob accepts an upload and converts it in the background. It responds
+// immediately with the job's state; clients poll GetJob for the results or
+// pass a callbackUrl to have them posted when the job finishes.
+func (h *handler) CreateJob(w http.ResponseWriter, r *http.Request) {
+	if h.fileManager.Busy() {
+		h.serverBusy(w)
+		return
+	}
+
+	f, ok := h.readFile(w, r)
+	if !ok {
+		return
+	}
+	callbackUrl, ok := h.readCallbackUrl(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := h.fileManager.Submit(r.Context(), f)
+	if err != nil {
+		writeError(w, fileError(err))
+		return
+	}
+	if callbackUrl != "" {
+		go func() {
+			<-job.Done()
+			h.notify(callbackUrl, jobCallback(job))
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%s", job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(newJobState(job.State()))
+}
+
+// GetJob returns the status, progress and results of a job.
+func (h *handler) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.fileManager.GetJob(r.PathValue("id"))
+	if !ok {
+		writeError(w, newError(http.StatusNotFound, CodeNotFound, "Job not found"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newJobState(job.State()))
+}
+
+// CancelJob stops a job. Formats that were already converted are kept.
+func (h *handler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.fileManager.GetJob(r.PathValue("id"))
+	if !ok {
+		writeError(w, newError(http.StatusNotFound, CodeNotFound, "Job not found"))
+		return
+	}
+	job.Cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newJobState(job.State()))
+}
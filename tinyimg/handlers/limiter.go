@@ -1,82 +1,61 @@
 package handlers
 
-//yanked from here: https://www.alexedwards.net/blog/how-to-rate-limit-http-requests
-
 import (
 	"fmt"
-	"golang.org/x/time/rate"
-	"log"
-	"net"
+	"log/slog"
+	"math"
 	"net/http"
-	"sync"
-	"time"
-)
-
-// Create a custom visitor struct which holds the rate limiter for each
-// visitor and the last time that the visitor was seen.
-type visitor struct {
-	limiter  *rate.Limiter
-	lastSeen time.Time
-}
-
-// Change the map to hold values of the type visitor.
-var visitors = make(map[string]*visitor)
-var mu sync.Mutex
-
-// Run a background goroutine to remove old entries from the visitors map.
-func init() {
-	go cleanupVisitors()
-}
-
-func getVisitor(ip string) *rate.Limiter {
-	mu.Lock()
-	defer mu.Unlock()
+	"strconv"
 
-	v, exists := visitors[ip]
-	fmt.Println(ip)
-	if !exists {
-		limiter := rate.NewLimiter(15, 30)
-		// Include the current time when creating a new visitor.
-		visitors[ip] = &visitor{limiter, time.Now()}
-		return limiter
-	}
-
-	// Update the last seen time for the visitor.
-	v.lastSeen = time.Now()
-	return v.limiter
-}
-
-// Every minute check the map for visitors that haven't been seen for
-// more than 3 minutes and delete the entries.
-func cleanupVisitors() {
-	for {
-		time.Sleep(time.Minute)
+	"github.com/dunkbing/tinyimg/tinyimg/cache"
+	"github.com/dunkbing/tinyimg/tinyimg/clientip"
+	"github.com/dunkbing/tinyimg/tinyimg/config"
+	"github.com/dunkbing/tinyimg/tinyimg/metrics"
+	"github.com/dunkbing/tinyimg/tinyimg/ratelimit"
+)
 
-		mu.Lock()
-		for ip, v := range visitors {
-			if time.Since(v.lastSeen) > 3*time.Minute {
-				delete(visitors, ip)
-			}
+// newLimiter creates the rate limiter for the configured backend. The Redis
+// one falls back to limiting each process on its own while Redis fails.
+func newLimiter(o *config.RateLimitOptions) (ratelimit.Limiter, error) {
+	switch o.Backend {
+	case "redis":
+		client, err := cache.GetRedisClient()
+		if err != nil {
+			return nil, err
 		}
-		mu.Unlock()
+		return &ratelimit.Fallback{
+			Primary:  ratelimit.NewRedis(client, o.RedisPrefix),
+			Fallback: ratelimit.NewMemory(),
+		}, nil
+	default:
+		return ratelimit.NewMemory(), nil
 	}
 }
 
-func Limit(next http.Handler) http.Handler {
+// Limit rejects the requests of clients going over the configured rate
+// limit. Clients are told apart by the address found by ClientIP. The
+// backend is chosen once; the limits are read on every request.
+func Limit(next http.Handler) (http.Handler, error) {
+	limiter, err := newLimiter(config.GetConfig().App.RateLimitOpt)
+	if err != nil {
+		return nil, fmt.Errorf("rate limiter: %w", err)
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := clientip.FromRequest(r)
+		o := config.GetConfig().App.RateLimitOpt
+		ok, retryAfter, err := limiter.Allow(r.Context(), ip, ratelimit.Limit{Rate: o.Rate, Burst: o.Burst})
 		if err != nil {
-			log.Print(err.Error())
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
-
-		limiter := getVisitor(ip)
-		if !limiter.Allow() {
-			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		if !ok {
+			slog.Info("Rate limited", "ip", ip, "path", r.URL.Path)
+			metrics.LimiterRejections.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, newError(http.StatusTooManyRequests, CodeRateLimited, "Too many requests, please slow down"))
 			return
 		}
 
 		next.ServeHTTP(w, r)
-	})
+	}), nil
 }
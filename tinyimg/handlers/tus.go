@@ -0,0 +1,407 @@
+package handlers
+
+// Resumable uploads following the tus 1.0.0 protocol, with the creation and
+// termination extensions: https://tus.io/protocols/resumable-upload
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	// jobIdHeader tells tus clients which job converts a completed upload.
+	jobIdHeader = "X-Job-Id"
+)
+
+var tusIdPattern = regexp.MustCompile(`^[0-9a-f-]{36}$`)
+
+// tusUpload is the state of a resumable upload, persisted next to its data
+// so uploads survive restarts. Once the upload is complete its data is
+// handed to a job, and the state is kept with the job ID until the upload is
+// terminated or expired by the janitor.
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata"`
+	RawMeta  string            `json:"rawMetadata"`
+	JobID    string            `json:"jobId,omitempty"`
+}
+
+// tusBusy holds the uploads a PATCH or DELETE request is working on.
+// Requests don't wait for each other: a concurrent one is answered with 423
+// Locked, so a slow client can't hold up others while its chunk is read.
+// HEAD reads the state without claiming the upload, as it is replaced
+// atomically.
+var (
+	tusBusyMu sync.Mutex
+	tusBusy   = map[string]bool{}
+)
+
+// claimTusUpload marks an upload as busy. It returns false if another
+// request already did, or a function releasing the upload.
+func claimTusUpload(id string) (func(), bool) {
+	tusBusyMu.Lock()
+	defer tusBusyMu.Unlock()
+	if tusBusy[id] {
+		return nil, false
+	}
+	tusBusy[id] = true
+	return func() {
+		tusBusyMu.Lock()
+		delete(tusBusy, id)
+		tusBusyMu.Unlock()
+	}, true
+}
+
+// errTusLocked is answered to a request on an upload that is busy.
+var errTusLocked = newError(http.StatusLocked, CodeUploadLocked, "Upload is used by another request")
+
+func (h *handler) tusDir() string {
+	return filepath.Join(h.app().InDir, "tus")
+}
+
+func (h *handler) tusDataPath(id string) string {
+	return filepath.Join(h.tusDir(), id)
+}
+
+func (h *handler) tusInfoPath(id string) string {
+	return filepath.Join(h.tusDir(), id+".info")
+}
+
+func (h *handler) loadTusUpload(id string) (*tusUpload, error) {
+	if !tusIdPattern.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(h.tusInfoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	u := &tusUpload{}
+	return u, json.Unmarshal(data, u)
+}
+
+func (h *handler) saveTusUpload(u *tusUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := h.tusInfoPath(u.ID) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.tusInfoPath(u.ID))
+}
+
+// tusHeaders sets the headers every tus response carries and checks the
+// client speaks a supported version. It writes the error response and
+// returns false otherwise.
+func tusHeaders(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Access-Control-Expose-Headers",
+		"Location, Upload-Offset, Upload-Length, Upload-Metadata, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, "+jobIdHeader)
+	if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, newError(http.StatusPreconditionFailed, CodeUnsupportedVersion, "Unsupported tus version"))
+		return false
+	}
+	return true
+}
+
+// TusOptions describes the tus features supported by the server.
+func (h *handler) TusOptions(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w, r)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.app().MaxFileSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreate creates a resumable upload. The filename, formats and
+// callbackUrl fields can be passed in Upload-Metadata.
+func (h *handler) TusCreate(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	if h.fileManager.Busy() {
+		h.serverBusy(w)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, newError(http.StatusBadRequest, CodeInvalidHeader, "Invalid Upload-Length"))
+		return
+	}
+	if maxSize := h.app().MaxFileSize; length > maxSize {
+		writeError(w, errTooLarge(maxSize))
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, newError(http.StatusBadRequest, CodeInvalidHeader, "Invalid Upload-Metadata"))
+		return
+	}
+	if callbackUrl := metadata["callbackUrl"]; callbackUrl != "" {
+		if !h.validCallbackUrl(w, r, callbackUrl) {
+			return
+		}
+	}
+
+	u := &tusUpload{
+		ID:       uuid.New().String(),
+		Length:   length,
+		Metadata: metadata,
+		RawMeta:  r.Header.Get("Upload-Metadata"),
+	}
+	if err = os.MkdirAll(h.tusDir(), 0777); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err = os.WriteFile(h.tusDataPath(u.ID), nil, 0644); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err = h.saveTusUpload(u); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/files/%s", u.ID))
+	if length == 0 && !h.completeTusUpload(w, r, u) {
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusHead returns the offset of a resumable upload, and the ID of the job
+// converting it once it is complete.
+func (h *handler) TusHead(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	u, err := h.loadTusUpload(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.RawMeta != "" {
+		w.Header().Set("Upload-Metadata", u.RawMeta)
+	}
+	if u.JobID != "" {
+		w.Header().Set(jobIdHeader, u.JobID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatch appends a chunk to a resumable upload. Once every byte has been
+// received the image is converted in the background and the job ID is
+// returned in the X-Job-Id header.
+func (h *handler) TusPatch(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	if h.fileManager.Busy() {
+		h.serverBusy(w)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, newError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Invalid Content-Type"))
+		return
+	}
+	id := r.PathValue("id")
+	release, ok := claimTusUpload(id)
+	if !ok {
+		writeError(w, errTusLocked)
+		return
+	}
+	defer release()
+	u, err := h.loadTusUpload(id)
+	if err != nil {
+		writeError(w, newError(http.StatusNotFound, CodeNotFound, "Upload not found"))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.Offset {
+		writeError(w, newError(http.StatusConflict, CodeOffsetMismatch, "Upload-Offset does not match"))
+		return
+	}
+	if u.Offset == u.Length {
+		writeError(w, newError(http.StatusForbidden, CodeUploadComplete, "Upload is already complete"))
+		return
+	}
+
+	f, err := os.OpenFile(h.tusDataPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err = f.Seek(u.Offset, io.SeekStart); err != nil {
+		f.Close()
+		writeError(w, err)
+		return
+	}
+	// keep whatever arrived, even if the connection breaks mid-chunk
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, u.Length-u.Offset))
+	if err = f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	u.Offset += n
+	if err = h.saveTusUpload(u); err != nil {
+		writeError(w, err)
+		return
+	}
+	if copyErr != nil {
+		slog.Info("tus chunk interrupted", "id", id, "offset", u.Offset, "err", copyErr)
+		writeError(w, newError(http.StatusBadRequest, CodeReadFailed, "Error reading the chunk"))
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	if u.Offset == u.Length && !h.completeTusUpload(w, r, u) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusDelete terminates a resumable upload and removes its data.
+func (h *handler) TusDelete(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	release, ok := claimTusUpload(id)
+	if !ok {
+		writeError(w, errTusLocked)
+		return
+	}
+	defer release()
+	if _, err := h.loadTusUpload(id); err != nil {
+		writeError(w, newError(http.StatusNotFound, CodeNotFound, "Upload not found"))
+		return
+	}
+	h.removeTusUpload(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeTusUpload removes the data and the state of an upload.
+func (h *handler) removeTusUpload(id string) {
+	_ = os.Remove(h.tusDataPath(id))
+	_ = os.Remove(h.tusInfoPath(id))
+}
+
+// completeTusUpload feeds a finished upload into the conversion path and
+// records the job ID in its state. The upload is removed if the image can't
+// be converted. It writes the error response and returns false on failure.
+func (h *handler) completeTusUpload(w http.ResponseWriter, r *http.Request, u *tusUpload) (ok bool) {
+	defer func() {
+		if !ok {
+			h.removeTusUpload(u.ID)
+		}
+	}()
+	// saveFile moves the data to the input directory, or removes it
+	received, err := inspect(u.Metadata["filename"], h.tusDataPath(u.ID))
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	var formats []string
+	if formatStr := u.Metadata["formats"]; formatStr != "" {
+		formats = strings.Split(formatStr, ",")
+	}
+	preset, err := h.lookupPreset(u.Metadata["preset"])
+	if err != nil {
+		received.discard()
+		writeError(w, err)
+		return false
+	}
+	f, err := h.saveFile(received, formats, preset)
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	job, err := h.fileManager.Submit(r.Context(), f)
+	if err != nil {
+		writeError(w, fileError(err))
+		return false
+	}
+	u.JobID = job.ID
+	if err = h.saveTusUpload(u); err != nil {
+		// the job runs anyway, only HEAD won't find it
+		slog.Error("Error saving tus upload", "id", u.ID, "err", err)
+	}
+	if callbackUrl := u.Metadata["callbackUrl"]; callbackUrl != "" {
+		go func() {
+			<-job.Done()
+			h.notify(callbackUrl, jobCallback(job))
+		}()
+	}
+
+	w.Header().Set(jobIdHeader, job.ID)
+	return true
+}
+
+// inspect hashes and sniffs a file that is already on disk, so it can be
+// saved like a spooled upload.
+func inspect(name, path string) (upload, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return upload{}, err
+	}
+	defer f.Close()
+
+	var sniff sniffer
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(h, &sniff), f)
+	if err != nil {
+		return upload{}, err
+	}
+	return upload{
+		name:     name,
+		path:     path,
+		size:     size,
+		hash:     hex.EncodeToString(h.Sum(nil)),
+		mimeType: http.DetectContentType(sniff.buf),
+	}, nil
+}
+
+// parseTusMetadata parses an Upload-Metadata header: comma separated pairs
+// of a key and an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dunkbing/tinyimg/tinyimg/config"
+)
+
+// newTusServer returns the tus routes of the test handlers.
+func newTusServer(t *testing.T) (*handler, http.Handler) {
+	t.Helper()
+	h := newTestHandler(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("OPTIONS /files", h.TusOptions)
+	mux.HandleFunc("POST /files", h.TusCreate)
+	mux.HandleFunc("HEAD /files/{id}", h.TusHead)
+	mux.HandleFunc("PATCH /files/{id}", h.TusPatch)
+	mux.HandleFunc("DELETE /files/{id}", h.TusDelete)
+	return h, mux
+}
+
+// tusRequest sends a tus request to mux and returns the response.
+func tusRequest(mux http.Handler, method, path string, headers map[string]string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// createTusUpload creates an upload of length bytes and returns its path.
+func createTusUpload(t *testing.T, mux http.Handler, length int) string {
+	t.Helper()
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("image.png")) +
+		",formats " + base64.StdEncoding.EncodeToString([]byte("png,webp"))
+	w := tusRequest(mux, http.MethodPost, "/files", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": meta,
+	}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func patchTus(mux http.Handler, path string, offset int, body io.Reader) *httptest.ResponseRecorder {
+	return tusRequest(mux, http.MethodPatch, path, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}, body)
+}
+
+func headTus(t *testing.T, mux http.Handler, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := tusRequest(mux, http.MethodHead, path, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("head: status %d", w.Code)
+	}
+	return w
+}
+
+// brokenReader returns its data, then fails like a dropped connection.
+type brokenReader struct {
+	data []byte
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestTusOptions(t *testing.T) {
+	_, mux := newTusServer(t)
+	r := httptest.NewRequest(http.MethodOptions, "/files", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d", w.Code)
+	}
+	maxSize := strconv.FormatInt(config.GetConfig().App.MaxFileSize, 10)
+	for name, want := range map[string]string{
+		"Tus-Resumable": tusVersion,
+		"Tus-Version":   tusVersion,
+		"Tus-Extension": tusExtensions,
+		"Tus-Max-Size":  maxSize,
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	h, mux := newTusServer(t)
+	img := testPNG(t, 100)
+	half := len(img) / 2
+	path := createTusUpload(t, mux, len(img))
+
+	if w := headTus(t, mux, path); w.Header().Get("Upload-Offset") != "0" ||
+		w.Header().Get("Upload-Length") != strconv.Itoa(len(img)) || w.Header().Get(jobIdHeader) != "" {
+		t.Fatalf("head of a new upload: %v", w.Header())
+	}
+
+	w := patchTus(mux, path, 0, bytes.NewReader(img[:half]))
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("first chunk: status %d, offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w = headTus(t, mux, path); w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("offset after the first chunk %s", w.Header().Get("Upload-Offset"))
+	}
+
+	// the chunk must start where the upload stopped
+	if w = patchTus(mux, path, 0, bytes.NewReader(img[half:])); w.Code != http.StatusConflict {
+		t.Fatalf("chunk at a stale offset: status %d", w.Code)
+	}
+	w = tusRequest(mux, http.MethodPatch, path, map[string]string{
+		"Content-Type":  "application/octet-stream",
+		"Upload-Offset": strconv.Itoa(half),
+	}, bytes.NewReader(img[half:]))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("chunk with a wrong content type: status %d", w.Code)
+	}
+
+	w = patchTus(mux, path, half, bytes.NewReader(img[half:]))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("last chunk: status %d: %s", w.Code, w.Body)
+	}
+	jobId := w.Header().Get(jobIdHeader)
+	job, ok := h.fileManager.GetJob(jobId)
+	if !ok {
+		t.Fatalf("job %q of the completed upload not found", jobId)
+	}
+	select {
+	case <-job.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("job did not finish")
+	}
+	if state := job.State(); len(state.Errors) > 0 {
+		t.Fatalf("job failed: %v", state.Errors)
+	}
+
+	// a completed upload can still be looked up until it is terminated
+	w = headTus(t, mux, path)
+	if w.Header().Get("Upload-Offset") != strconv.Itoa(len(img)) || w.Header().Get(jobIdHeader) != jobId {
+		t.Fatalf("head of a completed upload: %v", w.Header())
+	}
+	if w = patchTus(mux, path, len(img), bytes.NewReader(nil)); w.Code != http.StatusForbidden {
+		t.Fatalf("chunk of a completed upload: status %d", w.Code)
+	}
+
+	if w = tusRequest(mux, http.MethodDelete, path, nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d", w.Code)
+	}
+	if w = tusRequest(mux, http.MethodHead, path, nil, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("head of a terminated upload: status %d", w.Code)
+	}
+	if w = tusRequest(mux, http.MethodDelete, path, nil, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("delete of a terminated upload: status %d", w.Code)
+	}
+}
+
+func TestTusResume(t *testing.T) {
+	_, mux := newTusServer(t)
+	img := testPNG(t, 101)
+	path := createTusUpload(t, mux, len(img))
+
+	// the bytes received before the connection broke are kept
+	const received = 20
+	w := patchTus(mux, path, 0, &brokenReader{data: img[:received]})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("interrupted chunk: status %d", w.Code)
+	}
+	offset := headTus(t, mux, path).Header().Get("Upload-Offset")
+	if offset != strconv.Itoa(received) {
+		t.Fatalf("offset after an interrupted chunk %s, want %d", offset, received)
+	}
+
+	w = patchTus(mux, path, received, bytes.NewReader(img[received:]))
+	if w.Code != http.StatusNoContent || w.Header().Get(jobIdHeader) == "" {
+		t.Fatalf("resumed chunk: status %d, job %q: %s", w.Code, w.Header().Get(jobIdHeader), w.Body)
+	}
+}
+
+func TestTusConcurrentRequests(t *testing.T) {
+	_, mux := newTusServer(t)
+	img := testPNG(t, 102)
+	path := createTusUpload(t, mux, len(img))
+
+	// a chunk whose body arrives slowly claims the upload
+	pr, pw := io.Pipe()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- patchTus(mux, path, 0, pr) }()
+	if _, err := pw.Write(img[:10]); err != nil {
+		t.Fatal(err)
+	}
+
+	// other requests are turned away instead of waiting for it
+	if w := patchTus(mux, path, 0, bytes.NewReader(img)); w.Code != http.StatusLocked {
+		t.Fatalf("concurrent chunk: status %d", w.Code)
+	}
+	if w := tusRequest(mux, http.MethodDelete, path, nil, nil); w.Code != http.StatusLocked {
+		t.Fatalf("concurrent delete: status %d", w.Code)
+	}
+	if w := headTus(t, mux, path); w.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("offset during a chunk %s", w.Header().Get("Upload-Offset"))
+	}
+
+	if _, err := pw.Write(img[10:]); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	if w := <-done; w.Code != http.StatusNoContent || w.Header().Get(jobIdHeader) == "" {
+		t.Fatalf("slow chunk: status %d: %s", w.Code, w.Body)
+	}
+	if w := tusRequest(mux, http.MethodDelete, path, nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete after the chunk: status %d", w.Code)
+	}
+}
+
+func TestTusCreateErrors(t *testing.T) {
+	_, mux := newTusServer(t)
+	maxSize := config.GetConfig().App.MaxFileSize
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"too large", map[string]string{"Upload-Length": strconv.FormatInt(maxSize+1, 10)}, http.StatusRequestEntityTooLarge},
+		{"no length", nil, http.StatusBadRequest},
+		{"negative length", map[string]string{"Upload-Length": "-1"}, http.StatusBadRequest},
+		{"invalid metadata", map[string]string{"Upload-Length": "10", "Upload-Metadata": "filename !!!"}, http.StatusBadRequest},
+		{"unsupported version", map[string]string{"Upload-Length": "10", "Tus-Resumable": "0.2.2"}, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := tusRequest(mux, http.MethodPost, "/files", tt.headers, nil); w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestTusInvalidImage(t *testing.T) {
+	_, mux := newTusServer(t)
+	data := []byte("not an image")
+	path := createTusUpload(t, mux, len(data))
+	if w := patchTus(mux, path, 0, bytes.NewReader(data)); w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	// an upload that can't be converted is removed
+	if w := tusRequest(mux, http.MethodHead, path, nil, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("head of a rejected upload: status %d", w.Code)
+	}
+}
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dunkbing/tinyimg/tinyimg/clientip"
+	"github.com/dunkbing/tinyimg/tinyimg/config"
+	"github.com/dunkbing/tinyimg/tinyimg/image"
+	"github.com/dunkbing/tinyimg/tinyimg/janitor"
+	"github.com/dunkbing/tinyimg/tinyimg/utils"
+	"hash"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxFieldSize is the largest non-file form field read from a multipart body.
+const maxFieldSize = 64 * 1024
+
+var errNotImage = newError(http.StatusUnsupportedMediaType, CodeNotImage, "Invalid file format. Only images are allowed.")
+
+// upload is an image read from a request: a file part, an entry of an
+// uploaded zip archive or a remote file. Its content is spooled to a
+// temporary file in the input directory while being hashed and sniffed, so
+// it is never held in memory.
+type upload struct {
+	name        string
+	path        string
+	size        int64
+	hash        string
+	mimeType    string
+	fromArchive bool
+	err         error
+}
+
+// discard removes the temporary file of an upload that won't be converted.
+func (u upload) discard() {
+	if u.path != "" {
+		_ = os.Remove(u.path)
+	}
+}
+
+// uploadRequest is the JSON form of an upload by URL.
+type uploadRequest struct {
+	Url         string `json:"url"`
+	Formats     string `json:"formats"`
+	Preset      string `json:"preset"`
+	CallbackUrl string `json:"callbackUrl"`
+}
+
+// sniffer keeps the first bytes written to it for content type detection.
+type sniffer struct {
+	buf []byte
+}
+
+func (s *sniffer) Write(p []byte) (int, error) {
+	if n := 512 - len(s.buf); n > 0 {
+		s.buf = append(s.buf, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// spool copies src to a temporary file in dir, hashing and sniffing it on the
+// way. Content larger than limit is rejected.
+func spool(name string, src io.Reader, dir string, limit int64) upload {
+	u := upload{name: name}
+	tmp, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		slog.Error("Error creating upload file", "err", err)
+		u.err = newError(http.StatusInternalServerError, CodeInternal, "Error writing the file")
+		return u
+	}
+	defer tmp.Close()
+	u.path = tmp.Name()
+
+	var (
+		h     hash.Hash = sha256.New()
+		sniff sniffer
+	)
+	u.size, err = io.Copy(io.MultiWriter(tmp, h, &sniff), io.LimitReader(src, limit+1))
+	switch {
+	case err != nil:
+		u.err = newError(http.StatusBadRequest, CodeReadFailed, "Error reading the file")
+	case u.size > limit:
+		u.err = errTooLarge(limit)
+	}
+	if u.err != nil {
+		u.discard()
+		u.path = ""
+		return u
+	}
+	u.hash = hex.EncodeToString(h.Sum(nil))
+	u.mimeType = http.DetectContentType(sniff.buf)
+	return u
+}
+
+// readUploads reads every file part of a request, expanding zip archives
+// into their images, or fetches the image given in the url field. Parts are
+// streamed one at a time, and the other fields become form values. Problems
+// with a single file are recorded on its upload; problems with the request
+// itself are written to the response and false is returned.
+func (h *handler) readUploads(w http.ResponseWriter, r *http.Request) ([]upload, bool) {
+	app := h.app()
+	r.Body = http.MaxBytesReader(w, r.Body, app.MaxBatchSize)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var uploads []upload
+	switch mediaType {
+	case "application/json":
+		var body uploadRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, newError(http.StatusBadRequest, CodeInvalidBody, "Error parsing request body"))
+			return nil, false
+		}
+		// expose the fields like form values to the rest of the handler
+		r.Form = url.Values{
+			"url":         {body.Url},
+			"formats":     {body.Formats},
+			"preset":      {body.Preset},
+			"callbackUrl": {body.CallbackUrl},
+		}
+		r.PostForm = r.Form
+	case "multipart/form-data":
+		var ok bool
+		if uploads, ok = h.readParts(w, r); !ok {
+			return nil, false
+		}
+	default:
+		if err := r.ParseForm(); err != nil {
+			writeError(w, newError(http.StatusBadRequest, CodeInvalidBody, "Error parsing request body"))
+			return nil, false
+		}
+	}
+
+	if remote := r.FormValue("url"); remote != "" && len(uploads) == 0 {
+		return []upload{h.fetchUpload(r, remote)}, true
+	}
+	if len(uploads) == 0 {
+		writeError(w, newError(http.StatusBadRequest, CodeNoFile, "No file was uploaded"))
+		return nil, false
+	}
+	if len(uploads) > app.MaxBatchFiles {
+		discardAll(uploads)
+		writeError(w, newError(http.StatusBadRequest, CodeTooManyFiles, fmt.Sprintf("Too many files (max %d)", app.MaxBatchFiles)))
+		return nil, false
+	}
+	return uploads, true
+}
+
+// readParts streams the parts of a multipart request.
+func (h *handler) readParts(w http.ResponseWriter, r *http.Request) ([]upload, bool) {
+	app := h.app()
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, newError(http.StatusBadRequest, CodeInvalidBody, "Error parsing request body"))
+		return nil, false
+	}
+
+	var uploads []upload
+	values := url.Values{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			discardAll(uploads)
+			writeError(w, readError(err, app.MaxBatchSize))
+			return nil, false
+		}
+
+		switch {
+		case part.FormName() == "file" && isZipPart(part):
+			archive := spool(part.FileName(), part, app.InDir, app.MaxBatchSize)
+			if archive.err != nil {
+				uploads = append(uploads, archive)
+				continue
+			}
+			uploads = append(uploads, h.readZip(archive)...)
+			archive.discard()
+		case part.FormName() == "file":
+			uploads = append(uploads, spool(part.FileName(), part, app.InDir, app.MaxFileSize))
+		case part.FileName() == "":
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err != nil {
+				discardAll(uploads)
+				writeError(w, newError(http.StatusBadRequest, CodeInvalidBody, "Error parsing request body"))
+				return nil, false
+			}
+			values.Add(part.FormName(), string(value))
+		}
+		_ = part.Close()
+
+		if len(uploads) > app.MaxBatchFiles {
+			discardAll(uploads)
+			writeError(w, newError(http.StatusBadRequest, CodeTooManyFiles, fmt.Sprintf("Too many files (max %d)", app.MaxBatchFiles)))
+			return nil, false
+		}
+	}
+	r.Form = values
+	r.PostForm = values
+	return uploads, true
+}
+
+// fetchUpload downloads the image at a client supplied URL.
+func (h *handler) fetchUpload(r *http.Request, remote string) upload {
+	app := h.app()
+	body, err := h.fetcher.Fetch(r.Context(), remote, app.MaxFileSize)
+	var u upload
+	switch {
+	case errors.Is(err, utils.ErrInvalidUrl):
+		u.err = newError(http.StatusBadRequest, CodeInvalidUrl, "Invalid URL")
+	case errors.Is(err, utils.ErrBlockedAddress):
+		u.err = newError(http.StatusBadRequest, CodeUrlNotAllowed, "The URL points to an address that is not allowed")
+	case errors.Is(err, utils.ErrTooLarge):
+		u.err = errTooLarge(app.MaxFileSize)
+	case errors.Is(err, utils.ErrTooManyRedirects):
+		u.err = newError(http.StatusBadRequest, CodeTooManyRedirects, "The URL redirects too many times")
+	case err != nil:
+		slog.Info("Error fetching remote image", "url", remote, "ip", clientip.FromRequest(r), "err", err)
+		u.err = newError(http.StatusBadGateway, CodeFetchFailed, "Error fetching the image")
+	default:
+		u = spool(path.Base(remote), body, app.InDir, app.MaxFileSize)
+		_ = body.Close()
+	}
+	u.name = path.Base(remote)
+	return u
+}
+
+func isZipPart(part *multipart.Part) bool {
+	return strings.EqualFold(path.Ext(part.FileName()), ".zip") ||
+		part.Header.Get("Content-Type") == "application/zip"
+}
+
+// readZip returns the images inside a spooled zip archive. Directories and
+// hidden files are skipped.
+func (h *handler) readZip(archive upload) []upload {
+	app := h.app()
+	zr, err := zip.OpenReader(archive.path)
+	if err != nil {
+		return []upload{{name: archive.name, err: newError(http.StatusBadRequest, CodeInvalidArchive, "Invalid zip archive")}}
+	}
+	defer zr.Close()
+
+	var uploads []upload
+	for _, entry := range zr.File {
+		name := path.Base(entry.Name)
+		if entry.FileInfo().IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(entry.Name, "__MACOSX/") {
+			continue
+		}
+		if len(uploads) == app.MaxBatchFiles {
+			// one past the limit is enough for readUploads to reject the batch
+			uploads = append(uploads, upload{name: entry.Name, fromArchive: true})
+			break
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			uploads = append(uploads, upload{name: entry.Name, fromArchive: true, err: newError(http.StatusBadRequest, CodeReadFailed, "Error reading the file")})
+			continue
+		}
+		// the header size can lie, so spool enforces the limit while reading
+		u := spool(entry.Name, rc, app.InDir, app.MaxFileSize)
+		_ = rc.Close()
+		u.fromArchive = true
+		uploads = append(uploads, u)
+	}
+	return uploads
+}
+
+// saveFile moves a spooled image into the input directory, named after its
+// content so distinct images never collide. The preset, which may be nil,
+// sets the formats when none were requested and may lower the size limit.
+func (h *handler) saveFile(u upload, formats []string, preset *config.Preset) (*image.File, error) {
+	startTime := time.Now()
+	if !isImage(u.mimeType) {
+		u.discard()
+		return nil, errNotImage
+	}
+	if preset != nil && preset.MaxFileSize > 0 && u.size > preset.MaxFileSize {
+		u.discard()
+		return nil, errTooLarge(preset.MaxFileSize)
+	}
+	if preset != nil && len(formats) == 0 {
+		formats = preset.Formats
+	}
+	fileType, _ := image.GetFileType(u.mimeType)
+	ext := fmt.Sprintf(".%s", fileType)
+	filename := fmt.Sprintf("%s%s", u.hash, ext)
+
+	dest := filepath.Join(h.app().InDir, filename)
+	if isFileUploaded(dest) {
+		u.discard()
+		janitor.Touch(dest)
+	} else {
+		slog.Info("Upload", "dest", dest)
+		if err := os.Rename(u.path, dest); err != nil {
+			u.discard()
+			return nil, err
+		}
+	}
+	slog.Debug("Saved upload", "dest", dest, "took", time.Since(startTime))
+
+	if len(formats) == 0 {
+		formats = []string{fileType}
+	}
+
+	return &image.File{
+		Ext:           ext,
+		MimeType:      u.mimeType,
+		Name:          filename,
+		Size:          u.size,
+		Formats:       formats,
+		InputFileDest: dest,
+		Preset:        preset,
+	}, nil
+}
+
+// readFormats returns the output formats requested in the formats field.
+func readFormats(r *http.Request) []string {
+	formatStr := r.FormValue("formats")
+	if formatStr == "" {
+		return nil
+	}
+	return strings.Split(formatStr, ",")
+}
+
+func errTooLarge(limit int64) error {
+	message := fmt.Sprintf("The file is too large (max %dMB)", limit>>20)
+	if limit < 1024*1024 {
+		message = fmt.Sprintf("The file is too large (max %d bytes)", limit)
+	}
+	return newError(http.StatusRequestEntityTooLarge, CodeFileTooLarge, message)
+}
+
+// readError maps the errors of reading a multipart body limited to limit
+// bytes.
+func readError(err error, limit int64) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errTooLarge(limit)
+	}
+	return newError(http.StatusBadRequest, CodeInvalidBody, "Error retrieving the files")
+}
+
+func discardAll(uploads []upload) {
+	for _, u := range uploads {
+		u.discard()
+	}
+}
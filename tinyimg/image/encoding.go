@@ -0,0 +1,131 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dunkbing/tinyimg/tinyimg/config"
+	"github.com/dunkbing/tinyimg/tinyimg/jpeg"
+	"github.com/dunkbing/tinyimg/tinyimg/png"
+	"github.com/dunkbing/tinyimg/tinyimg/utils"
+	"github.com/dunkbing/tinyimg/tinyimg/webp"
+)
+
+// unbounded is the width given to vips when only the height is bounded.
+const unbounded = 10000000
+
+// encoding is what a conversion's output depends on besides the input: the
+// encoder options of its format, with the file's preset applied, and the
+// bounds it is resized to.
+type encoding struct {
+	format string
+	jpeg   jpeg.Options
+	png    png.Options
+	webp   webp.Options
+	width  int
+	height int
+}
+
+// newEncoding returns the encoding of format with the options of c and the
+// overrides of preset, which may be nil.
+func newEncoding(c *config.Config, format string, preset *config.Preset) *encoding {
+	e := &encoding{
+		format: format,
+		jpeg:   *c.App.JpegOpt,
+		png:    *c.App.PngOpt,
+		webp:   *c.App.WebpOpt,
+	}
+	if preset == nil {
+		return e
+	}
+	if preset.Quality > 0 {
+		e.jpeg.Quality = preset.Quality
+		e.png.Quality = preset.Quality
+		e.webp.Quality = preset.Quality
+	}
+	if preset.Metadata != "" {
+		keep := preset.Metadata == "keep"
+		e.jpeg.KeepMetadata = keep
+		e.png.KeepMetadata = keep
+		e.webp.KeepMetadata = keep
+	}
+	e.width, e.height = preset.Width, preset.Height
+	return e
+}
+
+// key describes the settings that change the output. Timeouts don't.
+func (e *encoding) key() string {
+	var quality int
+	var keepMetadata, lossless bool
+	switch e.format {
+	case "jpg", "jpeg":
+		quality, keepMetadata = e.jpeg.Quality, e.jpeg.KeepMetadata
+	case "png":
+		quality, keepMetadata = e.png.Quality, e.png.KeepMetadata
+	case "webp":
+		quality, keepMetadata, lossless = e.webp.Quality, e.webp.KeepMetadata, e.webp.Lossless
+	}
+	return fmt.Sprintf("%s q=%d lossless=%t metadata=%t size=%dx%d",
+		e.format, quality, lossless, keepMetadata, e.width, e.height)
+}
+
+// filename returns the name of the output of the input named base, which
+// carries a hash of the settings so that outputs of the same image with
+// different settings never collide.
+func (e *encoding) filename(base string) string {
+	sum := sha256.Sum256([]byte(e.key()))
+	return base + "-" + hex.EncodeToString(sum[:4]) + "." + e.format
+}
+
+// prepareInput gives the file's input the base name of filename, resized
+// when the encoding is bounded, so the encoders write their output under
+// that name. The returned file must be removed after encoding.
+func (e *encoding) prepareInput(ctx context.Context, f *File, filename string) (string, error) {
+	name := strings.TrimSuffix(filename, filepath.Ext(filename)) + filepath.Ext(f.InputFileDest)
+	input := filepath.Join(filepath.Dir(f.InputFileDest), name)
+	_ = os.Remove(input)
+
+	if e.width == 0 && e.height == 0 {
+		if err := os.Link(f.InputFileDest, input); err != nil {
+			return "", err
+		}
+		return input, nil
+	}
+	width := e.width
+	if width == 0 {
+		width = unbounded
+	}
+	args := []string{"thumbnail", f.InputFileDest, input, strconv.Itoa(width), "--size", "down"}
+	if e.height > 0 {
+		args = append(args, "--height", strconv.Itoa(e.height))
+	}
+	if err := utils.RunCommand(ctx, "vips", args...); err != nil {
+		_ = os.Remove(input)
+		return "", fmt.Errorf("resizing: %w", err)
+	}
+	return input, nil
+}
+
+// encode encodes input into the format in outDir.
+func (e *encoding) encode(ctx context.Context, input, outDir string) (outputFile string, err error) {
+	switch e.format {
+	case "jpg", "jpeg":
+		outputFile, err = jpeg.Encode(ctx, input, outDir, &e.jpeg)
+	case "png":
+		outputFile, err = png.Encode(ctx, input, outDir, &e.png)
+	case "webp":
+		outputFile, err = webp.Encode(ctx, input, outDir, &e.webp)
+	default:
+		err = fmt.Errorf("%w: %s", ErrUnsupportedFormat, e.format)
+	}
+	if err != nil {
+		return "", err
+	}
+	return outputFile, nil
+}
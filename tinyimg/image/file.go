@@ -1,26 +1,23 @@
 package image
 
 import (
-	"archive/zip"
-	"bytes"
-	"crypto/md5"
-	"encoding/hex"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/dunkbing/tinyimg/tinyimg/cache"
 	"github.com/dunkbing/tinyimg/tinyimg/config"
-	"github.com/dunkbing/tinyimg/tinyimg/jpeg"
-	"github.com/dunkbing/tinyimg/tinyimg/png"
-	"github.com/dunkbing/tinyimg/tinyimg/webp"
+	"github.com/dunkbing/tinyimg/tinyimg/metrics"
+	"github.com/dunkbing/tinyimg/tinyimg/storage"
+	"github.com/dunkbing/tinyimg/tinyimg/tracing"
 	"image"
-	"io"
 	"log/slog"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var mimes = map[string]string{
@@ -33,53 +30,91 @@ var mimes = map[string]string{
 
 var logger = slog.Default()
 
-// File represents an image file.
+var (
+	// ErrUnsupportedImage is returned for input files that are not a
+	// supported image.
+	ErrUnsupportedImage = errors.New("unsupported image")
+	// ErrUnsupportedFormat is returned for output formats that can't be
+	// encoded.
+	ErrUnsupportedFormat = errors.New("unsupported target format")
+	// ErrStorage is returned when a converted file can't be stored.
+	ErrStorage = errors.New("storing output")
+)
+
+// FormatError is the failure of one output format of a conversion.
+type FormatError struct {
+	Format string
+	Err    error
+}
+
+func (e *FormatError) Error() string {
+	return e.Format + ": " + e.Err.Error()
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// File represents an image file. Its content stays on disk at
+// InputFileDest and is read by the external encoders.
 type File struct {
-	Data          []byte `json:"data"`
 	Ext           string `json:"ext"`
 	MimeType      string `json:"type"`
 	Name          string `json:"name"`
 	Size          int64  `json:"size"`
-	ConvertedFile string
 	InputFileDest string
-	Image         image.Image
 	Formats       []string
-	cache         *cache.Cache[string, CompressResult]
+	// Preset overrides the configured encoder options when it is not nil.
+	Preset *config.Preset
 }
 
-// Decode decodes the file's data based on its mime type.
-func (f *File) Decode() error {
+// Decode reads the file's header to find its real format and renames the
+// input file to match it. The pixels are not decoded.
+func (f *File) Decode(ctx context.Context) (err error) {
+	_, span := tracing.Start(ctx, "Decode", attribute.String("file.type", f.MimeType))
+	defer func() { tracing.End(span, err) }()
+
 	mime, err := GetFileType(f.MimeType)
-	logger.Info("mime", "mime", mime)
 	if err != nil {
 		return err
 	}
-
 	switch mime {
-	case "jpg", "jpeg":
-		f.Image, f.Ext, err = jpeg.DecodeJPEG(bytes.NewReader(f.Data))
-	case "png":
-		f.Image, f.Ext, err = png.DecodePNG(bytes.NewReader(f.Data))
-	case "webp":
-		f.Image, f.Ext, err = webp.DecodeWebp(bytes.NewReader(f.Data))
+	case "jpg", "jpeg", "png", "webp":
 	default:
-		err = errors.New("unsupported file type:" + mime)
+		return fmt.Errorf("%w: %s", ErrUnsupportedImage, f.MimeType)
 	}
+
+	in, err := os.Open(f.InputFileDest)
 	if err != nil {
 		return err
 	}
+	_, realFormat, err := image.DecodeConfig(in)
+	in.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnsupportedImage, err)
+	}
+	if realFormat == "jpeg" {
+		realFormat = "jpg"
+	}
+	f.Ext = realFormat
+
 	newFileName := strings.Split(f.InputFileDest, ".")[0] + "." + f.Ext
-	err = os.Rename(f.InputFileDest, newFileName)
+	if newFileName == f.InputFileDest {
+		return nil
+	}
+	if _, err = os.Stat(newFileName); err == nil {
+		// another request with the same content already renamed it
+		_ = os.Remove(f.InputFileDest)
+	} else if err = os.Rename(f.InputFileDest, newFileName); err != nil {
+		return err
+	}
 	f.InputFileDest = newFileName
-	return err
+	return nil
 }
 
-// GetConvertedSize returns the size of the converted file.
-func (f *File) GetConvertedSize() (int64, error) {
-	if f.ConvertedFile == "" {
-		return 0, errors.New("file has no converted file")
-	}
-	s, err := os.Stat(f.ConvertedFile)
+// GetConvertedSize returns the size of the converted file at the given path.
+func GetConvertedSize(convertedFile string) (int64, error) {
+	s, err := os.Stat(convertedFile)
 	if err != nil {
 		return 0, err
 	}
@@ -87,8 +122,8 @@ func (f *File) GetConvertedSize() (int64, error) {
 }
 
 // GetSavings returns the delta between original and converted file size.
-func (f *File) GetSavings() (int64, error) {
-	c, err := f.GetConvertedSize()
+func (f *File) GetSavings(convertedFile string) (int64, error) {
+	c, err := GetConvertedSize(convertedFile)
 	if err != nil {
 		return 0, err
 	}
@@ -103,50 +138,48 @@ type CompressResult struct {
 	Format     string `json:"format"`
 }
 
-// Write saves a file to disk based on the encoding target.
-func (f *File) Write(c *config.Config) ([]CompressResult, []string, []error) {
-	var errs []error
-	t := time.Now()
-	var compressedFiles []string
-
+// Write saves a file to disk based on the encoding target. Formats are
+// encoded concurrently, bounded by the encoder pool, so every result is
+// stored by index and errors are collected under a lock. Encoding stops when
+// ctx is done. If progress is not nil it is called after each format.
+// Converted files are moved to the FileManager's storage, keyed by the file
+// name used in their URL, which depends on the encoder options.
+func (f *File) Write(ctx context.Context, fm *FileManager, progress func()) ([]CompressResult, []string, []error) {
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+
+	// read once so that a reload can't change the options midway
+	c := config.GetConfig()
 	formats := f.Formats
 	res := make([]CompressResult, len(formats))
+	compressedFiles := make([]string, len(formats))
 	var wg sync.WaitGroup
 	wg.Add(len(formats))
 	for i, format := range formats {
 		go func(format string, index int) {
 			defer wg.Done()
-			var savedBytes, newSize int64 // bytes
-			filename := strings.Split(f.Name, ".")[0]
-			filename = filename + "." + format
-
-			compressedFiles = append(compressedFiles, filename)
-			if cachedRes, ok := f.cache.Get(filename); ok {
-				res[index] = cachedRes
-				return
+			if progress != nil {
+				defer progress()
 			}
-
-			outputFile, err := encToBuf(f, format)
+			enc := newEncoding(c, format, f.Preset)
+			filename := enc.filename(strings.Split(f.Name, ".")[0])
+
+			compressedFiles[index] = filename
+			ctx, span := tracing.Start(ctx, "Write "+format,
+				attribute.String("format", format),
+				attribute.String("file.name", filename),
+			)
+			result, err := f.convertShared(ctx, fm, c, enc, filename)
+			tracing.End(span, err)
 			if err != nil {
-				errs = append(errs, err)
+				mu.Lock()
+				errs = append(errs, &FormatError{Format: format, Err: err})
+				mu.Unlock()
 				return
 			}
-
-			nt := time.Since(t).Milliseconds()
-
-			f.ConvertedFile = filepath.Clean(outputFile)
-			savedBytes, _ = f.GetSavings()
-			newSize, _ = f.GetConvertedSize()
-			imageUrl := fmt.Sprintf("%s/image?f=%s", config.HostUrl, filename)
-
-			res[index] = CompressResult{
-				SavedBytes: savedBytes,
-				NewSize:    newSize,
-				Time:       nt,
-				ImageUrl:   imageUrl,
-				Format:     format,
-			}
-			f.cache.Set(filename, res[index])
+			res[index] = result
 		}(format, i)
 	}
 	wg.Wait()
@@ -154,108 +187,113 @@ func (f *File) Write(c *config.Config) ([]CompressResult, []string, []error) {
 	return res, compressedFiles, errs
 }
 
-// encToBuf encodes an image to a buffer using the configured target.
-func encToBuf(f *File, target string) (outputFile string, err error) {
-	c := config.GetConfig()
-	switch target {
-	case "jpg", "jpeg":
-		outputFile, err = jpeg.Encode(f.InputFileDest, c.App.OutDir)
-	case "png":
-		outputFile, err = png.Encode(f.InputFileDest, c.App.OutDir)
-	case "webp":
-		outputFile, err = webp.Encode(f.InputFileDest, c.App.OutDir)
-	}
-	if err != nil {
-		return "", err
-	}
-	return outputFile, nil
-}
-
-// GetFileType returns the file's type based on the given mime type.
-func GetFileType(t string) (string, error) {
-	m, prs := mimes[t]
-	if !prs {
-		_ = errors.New("unsupported file type:" + t)
+// convertShared converts the file with enc, or waits for the result of an
+// identical conversion that is already running, so concurrent uploads of the
+// same image encode it once. Conversions are identified by filename, which
+// depends on the content and the encoder options. A waiter whose leader was
+// canceled retries with its own ctx.
+func (f *File) convertShared(ctx context.Context, fm *FileManager, c *config.Config, enc *encoding, filename string) (CompressResult, error) {
+	for {
+		ch := fm.flight.DoChan(filename, func() (any, error) {
+			return f.convert(ctx, fm, c, enc, filename)
+		})
+		select {
+		case r := <-ch:
+			if r.Err != nil && ctx.Err() == nil &&
+				(errors.Is(r.Err, context.Canceled) || errors.Is(r.Err, context.DeadlineExceeded)) {
+				continue
+			}
+			if r.Shared {
+				logger.Info("shared conversion", "file", filename)
+				trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("shared", true))
+			}
+			if r.Err != nil {
+				return CompressResult{}, r.Err
+			}
+			return r.Val.(CompressResult), nil
+		case <-ctx.Done():
+			return CompressResult{}, ctx.Err()
+		}
 	}
-	return m, nil
 }
 
-func generateUniqueZipFilename(files []string) string {
-	// Concatenate all file names
-	var concatenatedNames string
-	for _, file := range files {
-		concatenatedNames += filepath.Base(file)
+// convert encodes the file with enc and stores the output under filename,
+// unless a cached result still has its output in storage.
+func (f *File) convert(ctx context.Context, fm *FileManager, c *config.Config, enc *encoding, filename string) (CompressResult, error) {
+	if cachedRes, ok := fm.cache.Get(filename); ok {
+		// the output may have been evicted since it was cached
+		if _, err := fm.storage.Stat(ctx, filename); err == nil {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cached", true))
+			return cachedRes, nil
+		}
+		fm.cache.Delete(filename)
 	}
 
-	// Calculate MD5 hash
-	hash := md5.New()
-	hash.Write([]byte(concatenatedNames))
-	hashInBytes := hash.Sum(nil)
-
-	// Convert the hash to a hexadecimal string
-	hashString := hex.EncodeToString(hashInBytes)
-
-	// Use the hash as the zip filename with a ".zip" extension
-	return hashString + ".zip"
-}
-
-func zipFiles(files []string, c *config.Config) (string, error) {
-	logger.Info("zipping files", "files", files)
+	format := enc.format
 	t := time.Now()
-	var baseFiles []string
-	for _, file := range files {
-		baseFiles = append(baseFiles, filepath.Base(file))
+	release, err := fm.pool.Acquire(ctx, encoderName(format))
+	if err != nil {
+		return CompressResult{}, err
 	}
-	name := generateUniqueZipFilename(baseFiles)
-	zipFile, err := os.Create(name)
+	input, err := enc.prepareInput(ctx, f, filename)
 	if err != nil {
-		return "", err
+		release()
+		return CompressResult{}, err
+	}
+	outputFile, err := enc.encode(ctx, input, c.App.OutDir)
+	_ = os.Remove(input)
+	release()
+	if err != nil {
+		return CompressResult{}, err
 	}
-	defer zipFile.Close()
-
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
-
-	for _, file := range files {
-		err := func(filename string) error {
-			f, err := os.Open(path.Join(c.App.OutDir, file))
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			info, err := f.Stat()
-			if err != nil {
-				return err
-			}
-
-			header, err := zip.FileInfoHeader(info)
-			if err != nil {
-				return err
-			}
 
-			header.Name = filepath.Base(file)
-			header.Method = zip.Deflate
+	took := time.Since(t)
+	nt := took.Milliseconds()
 
-			writer, err := zipWriter.CreateHeader(header)
-			if err != nil {
-				return err
-			}
+	outputFile = filepath.Clean(outputFile)
+	savedBytes, _ := f.GetSavings(outputFile)
+	newSize, _ := GetConvertedSize(outputFile)
+	metrics.ConversionDuration.WithLabelValues(encoderName(format)).Observe(took.Seconds())
+	if f.Size > 0 {
+		metrics.SizeRatio.WithLabelValues(encoderName(format)).Observe(float64(newSize) / float64(f.Size))
+	}
+	if err = storage.MoveFile(ctx, fm.storage, filename, outputFile); err != nil {
+		return CompressResult{}, fmt.Errorf("%w %s: %w", ErrStorage, filename, err)
+	}
+	imageUrl := fmt.Sprintf("%s/image?f=%s", c.App.HostUrl, filename)
+
+	result := CompressResult{
+		SavedBytes: savedBytes,
+		NewSize:    newSize,
+		Time:       nt,
+		ImageUrl:   imageUrl,
+		Format:     format,
+	}
+	fm.cache.Set(filename, result)
+	return result, nil
+}
 
-			_, err = io.Copy(writer, f)
-			if err != nil {
-				return err
-			}
-			return nil
-		}(file)
+// encoderTools are the external tools producing each output format, keyed by
+// encoderName.
+var encoderTools = map[string]string{
+	"jpg":  "jpegoptim",
+	"png":  "pngquant",
+	"webp": "cwebp",
+}
 
-		if err != nil {
-			continue
-		}
+// encoderName returns the name of the encoder pool used for a format.
+func encoderName(format string) string {
+	if format == "jpeg" {
+		return "jpg"
 	}
+	return format
+}
 
-	nt := time.Since(t).Milliseconds()
-	logger.Info("zipped files", "name", name, "time", nt)
-
-	return zipFile.Name(), nil
+// GetFileType returns the file's type based on the given mime type.
+func GetFileType(t string) (string, error) {
+	m, prs := mimes[t]
+	if !prs {
+		_ = errors.New("unsupported file type:" + t)
+	}
+	return m, nil
 }
@@ -0,0 +1,108 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dunkbing/tinyimg/tinyimg/utils"
+)
+
+// newCountingFileManager returns a FileManager whose png encoder logs each
+// run and takes a while, so concurrent conversions overlap, and a function
+// returning the number of runs.
+func newCountingFileManager(t *testing.T) (*FileManager, func() int) {
+	t.Helper()
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	// sleep doesn't inherit stderr, so a killed encoder is waited for at once
+	script := fmt.Sprintf("#!/bin/sh\necho run >> %q\nsleep 0.5 >/dev/null 2>&1\n", runs) + strings.TrimPrefix(fakeEncoder, "#!/bin/sh\n")
+	tool := filepath.Join(dir, "encoder")
+	if err := os.WriteFile(tool, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	utils.SetToolPaths(map[string]string{"pngquant": tool})
+	t.Cleanup(func() { utils.SetToolPaths(nil) })
+	fm, err := NewFileManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fm, func() int {
+		data, _ := os.ReadFile(runs)
+		return bytes.Count(data, []byte("\n"))
+	}
+}
+
+func TestConvertShared(t *testing.T) {
+	fm, runs := newCountingFileManager(t)
+	file, content := newTestFile(t, 1000, []string{"png"})
+	const n = 16
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results, files, errs := file.Write(context.Background(), fm, nil)
+			if len(errs) > 0 {
+				t.Error(errs)
+				return
+			}
+			checkOutputs(t, fm, file, content, results, files)
+		}()
+	}
+	wg.Wait()
+	if r := runs(); r != 1 {
+		t.Fatalf("%d uploads of the same image encoded it %d times, want 1", n, r)
+	}
+}
+
+func TestConvertSharedCanceledLeader(t *testing.T) {
+	fm, runs := newCountingFileManager(t)
+	file, content := newTestFile(t, 1001, []string{"png"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan []error)
+	go func() {
+		_, _, errs := file.Write(ctx, fm, nil)
+		leader <- errs
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for runs() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the leader never started encoding")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the follower joins the running conversion, then its leader is canceled
+	follower := make(chan error)
+	go func() {
+		results, files, errs := file.Write(context.Background(), fm, nil)
+		if len(errs) > 0 {
+			follower <- errors.Join(errs...)
+			return
+		}
+		checkOutputs(t, fm, file, content, results, files)
+		follower <- nil
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	if errs := <-leader; len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+		t.Fatalf("canceled leader returned %v", errs)
+	}
+	if err := <-follower; err != nil {
+		t.Fatalf("follower of a canceled leader failed: %v", err)
+	}
+	if r := runs(); r != 2 {
+		t.Fatalf("encoded %d times, want the canceled run and the retry", r)
+	}
+}
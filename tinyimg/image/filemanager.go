@@ -1,94 +1,252 @@
 package image
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/dunkbing/tinyimg/tinyimg/cache"
 	"github.com/dunkbing/tinyimg/tinyimg/config"
+	"github.com/dunkbing/tinyimg/tinyimg/metrics"
+	"github.com/dunkbing/tinyimg/tinyimg/pool"
 	"github.com/dunkbing/tinyimg/tinyimg/stat"
+	"github.com/dunkbing/tinyimg/tinyimg/storage"
+	"github.com/dunkbing/tinyimg/tinyimg/tracing"
 	"log/slog"
-	"runtime/debug"
 	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
 )
 
-// FileManager handles collections of Files for conversion.
+// FileManager creates conversion Jobs and holds the state they share.
 type FileManager struct {
-	File *File
-
 	Logger *slog.Logger
 
-	config *config.Config
-	stats  *stat.Stat
-	cache  *cache.Cache[string, CompressResult]
+	stats   *stat.Stat
+	cache   cache.Store[string, CompressResult]
+	pool    *pool.Pool
+	storage storage.Storage
+	jobs    *cache.Cache[string, *Job]
+	batches *cache.Cache[string, []string]
+	flight  singleflight.Group
 }
 
-// NewFileManager creates a new FileManager.
-func NewFileManager() *FileManager {
+// jobRetention is how long finished background jobs and batches can still be
+// looked up.
+const jobRetention = time.Hour
+
+// NewFileManager creates a new FileManager. It fails when the result cache,
+// the stat store, the storage or its metrics can't be set up.
+func NewFileManager() (*FileManager, error) {
 	logger := slog.Default()
-	logger.Info("FileManager initialized...")
-	cache_ := cache.NewCache[string, CompressResult]()
+	c := config.GetConfig()
+	cache_, err := newResultCache(c.App.CacheOpt)
+	if err != nil {
+		return nil, fmt.Errorf("result cache: %w", err)
+	}
+	statStore, err := newStatStore(c.App.StatOpt)
+	if err != nil {
+		return nil, fmt.Errorf("stat store: %w", err)
+	}
+	store, err := storage.New(c.App.StorageOpt)
+	if err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	stats, err := stat.NewStat(statStore, c.App.StatOpt.FlushInterval)
+	if err != nil {
+		return nil, fmt.Errorf("stats: %w", err)
+	}
 
 	fm := &FileManager{
-		config: config.GetConfig(),
-		stats:  stat.NewStat(),
-		Logger: logger,
-		cache:  cache_,
+		stats:   stats,
+		Logger:  logger,
+		cache:   cache_,
+		pool:    pool.New(c.App.PoolOpt),
+		storage: store,
+		jobs:    cache.NewCache[string, *Job](),
+		batches: cache.NewCache[string, []string](),
 	}
-	fm.startCacheClearing()
+	if err = fm.registerMetrics(); err != nil {
+		return nil, fmt.Errorf("metrics: %w", err)
+	}
+	fm.startCachePruning()
+	logger.Info("FileManager initialized...")
+
+	return fm, nil
+}
 
-	return fm
+// registerMetrics exposes the state of the encoder pool and the result cache
+// at /metrics and under /debug/vars. The cache hit ratio is
+// hits / (hits + misses).
+func (fm *FileManager) registerMetrics() error {
+	if expvar.Get("encoderPool") == nil {
+		expvar.Publish("encoderPool", expvar.Func(func() any { return fm.pool.Stats() }))
+	}
+	if expvar.Get("resultCache") == nil {
+		expvar.Publish("resultCache", expvar.Func(func() any { return fm.cache.Stats() }))
+	}
+	return errors.Join(
+		metrics.GaugeFunc("encoder_pool_capacity", "Encoder processes that may run at the same time.",
+			func() float64 { return float64(fm.pool.Stats().Capacity) }),
+		metrics.GaugeFunc("encoder_pool_running", "Encoder processes running.",
+			func() float64 { return float64(fm.pool.Stats().Running) }),
+		metrics.GaugeFunc("encoder_pool_queued", "Encodes waiting for a free worker.",
+			func() float64 { return float64(fm.pool.Stats().Queued) }),
+		metrics.CounterFunc("result_cache_hits_total", "Conversion results found in the cache.",
+			func() float64 { return float64(fm.cache.Stats().Hits) }),
+		metrics.CounterFunc("result_cache_misses_total", "Conversion results missing from the cache.",
+			func() float64 { return float64(fm.cache.Stats().Misses) }),
+		metrics.CounterFunc("result_cache_evictions_total", "Conversion results evicted from the cache.",
+			func() float64 { return float64(fm.cache.Stats().Evictions) }),
+	)
+}
+
+// newResultCache creates the cache of conversion results for the configured
+// backend.
+func newResultCache(o *config.CacheOptions) (cache.Store[string, CompressResult], error) {
+	switch o.Backend {
+	case "", "memory":
+		return cache.New(cache.Options[string, CompressResult]{
+			TTL:        o.TTL,
+			MaxEntries: o.MaxEntries,
+		}), nil
+	case "redis":
+		prefix := o.RedisPrefix
+		if prefix == "" {
+			prefix = "tinyimg:result:"
+		}
+		client, err := cache.GetRedisClient()
+		if err != nil {
+			return nil, err
+		}
+		return cache.NewRedisCache[string, CompressResult](client, prefix, o.TTL), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", o.Backend)
+	}
 }
 
-func (fm *FileManager) startCacheClearing() {
+// newStatStore creates the store of the app stats for the configured
+// backend. It is nil when stats are not persisted.
+func newStatStore(o *stat.Options) (stat.Store, error) {
+	switch o.Backend {
+	case "", "file":
+		return stat.NewFileStore(o.File)
+	case "redis":
+		client, err := cache.GetRedisClient()
+		if err != nil {
+			return nil, err
+		}
+		return stat.NewRedisStore(client, o.RedisPrefix), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown stats backend: %s", o.Backend)
+	}
+}
+
+// startCachePruning periodically drops the expired conversion results, so
+// results that are never read again don't hold memory until they are evicted.
+func (fm *FileManager) startCachePruning() {
 	go func() {
-		for {
-			fm.Logger.Info("Clearing cache...")
-			time.Sleep(10 * time.Minute)
-			fm.cache.Clear()
+		for range time.Tick(10 * time.Minute) {
+			n := fm.cache.Prune()
+			fm.Logger.Info("Pruned cache", "expired", n, "stats", fm.cache.Stats())
 		}
 	}()
 }
 
-// HandleFile processes a file from the client.
-func (fm *FileManager) HandleFile(file *File) (err error) {
-	if err = file.Decode(); err != nil {
-		return err
+// HandleFile processes a file from the client and returns the Job that
+// converts it.
+func (fm *FileManager) HandleFile(ctx context.Context, file *File) (job *Job, err error) {
+	ctx, span := tracing.Start(ctx, "HandleFile", attribute.String("file.name", file.Name))
+	defer func() { tracing.End(span, err) }()
+
+	if err = file.Decode(ctx); err != nil {
+		return nil, err
 	}
-	fm.File = file
-	fm.File.cache = fm.cache
-	fm.Logger.Info("added file to file manager", "filename", file.Name)
+	fm.Logger.Info("created conversion job", "filename", file.Name)
+
+	return newJob(file, fm), nil
+}
+
+// Submit processes a file from the client and converts it in the background.
+// The returned Job can be looked up with GetJob until jobRetention after it
+// finished. The conversion outlives ctx but stays in its trace.
+func (fm *FileManager) Submit(ctx context.Context, file *File) (*Job, error) {
+	job, err := fm.HandleFile(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	fm.jobs.Set(job.ID, job)
+	go func() {
+		job.Convert(context.WithoutCancel(ctx))
+		time.AfterFunc(jobRetention, func() {
+			fm.jobs.Delete(job.ID)
+		})
+	}()
 
-	return nil
+	return job, nil
 }
 
-// Clear removes the files in the FileManager.
-func (fm *FileManager) Clear() {
-	fm.File = nil
-	debug.FreeOSMemory()
+// GetJob returns the background job with the given ID.
+func (fm *FileManager) GetJob(id string) (*Job, bool) {
+	return fm.jobs.Get(id)
 }
 
-// Convert runs the conversion on all files in the FileManager.
-func (fm *FileManager) Convert() (fileResults []CompressResult, files []string, errs []error) {
-	startTime := time.Now()
-	file := fm.File
-	fileResults, files, errs = file.Write(fm.config)
+// Storage returns the storage holding the converted images.
+func (fm *FileManager) Storage() storage.Storage {
+	return fm.storage
+}
 
-	for _, f := range fileResults {
-		fm.stats.IncreaseByteCount(f.SavedBytes)
-		fm.stats.IncreaseTimeCount(f.Time)
-		fm.stats.IncreaseImageCount(1)
-	}
-	fm.Clear()
+// Busy reports whether the encoder pool would reject new conversions.
+func (fm *FileManager) Busy() bool {
+	return fm.pool.Full()
+}
 
-	took := time.Since(startTime).Seconds()
-	fmt.Println("Conversion took", took, "seconds")
+// RetryAfter returns the number of seconds clients should wait before
+// retrying a conversion rejected by a full encoder pool.
+func (fm *FileManager) RetryAfter() int {
+	return config.GetConfig().App.PoolOpt.RetryAfter
+}
 
-	return fileResults, files, errs
+// AddBatch remembers the output files of a batch upload and returns the token
+// used to download them together.
+func (fm *FileManager) AddBatch(files []string) string {
+	token := uuid.New().String()
+	fm.batches.Set(token, files)
+	time.AfterFunc(jobRetention, func() {
+		fm.batches.Delete(token)
+	})
+	return token
 }
 
-func (fm *FileManager) ZipFiles(files []string) (string, error) {
-	zippedFile, err := zipFiles(files, fm.config)
-	if err != nil {
-		return "", err
+// GetBatch returns the output files of the batch with the given token.
+func (fm *FileManager) GetBatch(token string) ([]string, bool) {
+	return fm.batches.Get(token)
+}
+
+// Stats returns the app stats.
+func (fm *FileManager) Stats() *stat.Stat {
+	return fm.stats
+}
+
+// recordStats adds the results of a conversion of file to the app stats.
+// Formats that failed have no result and are not counted.
+func (fm *FileManager) recordStats(file *File, results []CompressResult, took time.Duration) {
+	now := time.Now()
+	for _, r := range results {
+		if r.Format == "" {
+			continue
+		}
+		fm.stats.Record(
+			stat.Counts{ByteCount: r.SavedBytes, ImageCount: 1, TimeCount: r.Time},
+			now,
+			stat.InputFormat+file.Ext,
+			stat.OutputFormat+encoderName(r.Format),
+			stat.Encoder+encoderTools[encoderName(r.Format)],
+		)
 	}
-	return zippedFile, nil
+	fm.Logger.Debug("Conversion finished", "file", file.Name, "took", took)
 }
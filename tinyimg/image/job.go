@@ -0,0 +1,137 @@
+package image
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// JobStatus is the state of a conversion Job.
+type JobStatus string
+
+const (
+	JobQueued   JobStatus = "queued"
+	JobRunning  JobStatus = "running"
+	JobDone     JobStatus = "done"
+	JobFailed   JobStatus = "failed"
+	JobCanceled JobStatus = "canceled"
+)
+
+// Job is a single conversion request. Every upload gets its own Job, so
+// concurrent requests never share the file being converted.
+type Job struct {
+	ID   string
+	File *File
+
+	fm *FileManager
+
+	mu       sync.Mutex
+	status   JobStatus
+	done     int
+	results  []CompressResult
+	files    []string
+	errs     []error
+	cancel   context.CancelFunc
+	finished chan struct{}
+}
+
+// JobProgress is the number of formats of a Job that have been converted.
+type JobProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// JobState is a snapshot of a Job. Errors are the failures of its formats,
+// which handlers describe to clients in their own shape.
+type JobState struct {
+	ID       string           `json:"id"`
+	Status   JobStatus        `json:"status"`
+	Progress JobProgress      `json:"progress"`
+	Data     []CompressResult `json:"data"`
+	Files    []string         `json:"files"`
+	Errors   []error          `json:"-"`
+}
+
+func newJob(file *File, fm *FileManager) *Job {
+	return &Job{
+		ID:       uuid.New().String(),
+		File:     file,
+		fm:       fm,
+		status:   JobQueued,
+		finished: make(chan struct{}),
+	}
+}
+
+// Convert runs the conversion of the job's file into every requested format.
+// The encoders are stopped when ctx is done.
+func (j *Job) Convert(ctx context.Context) (fileResults []CompressResult, files []string, errs []error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	j.mu.Lock()
+	if j.status == JobCanceled {
+		j.mu.Unlock()
+		close(j.finished)
+		return nil, nil, []error{context.Canceled}
+	}
+	j.status = JobRunning
+	j.cancel = cancel
+	j.mu.Unlock()
+
+	startTime := time.Now()
+	fileResults, files, errs = j.File.Write(ctx, j.fm, j.formatDone)
+	j.fm.recordStats(j.File, fileResults, time.Since(startTime))
+
+	j.mu.Lock()
+	j.results, j.files, j.errs = fileResults, files, errs
+	switch {
+	case ctx.Err() != nil:
+		j.status = JobCanceled
+	case len(errs) > 0 && len(errs) == len(files):
+		j.status = JobFailed
+	default:
+		j.status = JobDone
+	}
+	j.mu.Unlock()
+	close(j.finished)
+
+	return fileResults, files, errs
+}
+
+// Cancel stops the conversion of the job. Formats already converted are kept.
+func (j *Job) Cancel() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch j.status {
+	case JobQueued:
+		j.status = JobCanceled
+	case JobRunning:
+		j.cancel()
+	}
+}
+
+// Done returns a channel that is closed when the job has finished.
+func (j *Job) Done() <-chan struct{} {
+	return j.finished
+}
+
+// State returns a snapshot of the job's status, progress and results.
+func (j *Job) State() JobState {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return JobState{
+		ID:       j.ID,
+		Status:   j.status,
+		Progress: JobProgress{Done: j.done, Total: len(j.File.Formats)},
+		Data:     j.results,
+		Files:    j.files,
+		Errors:   j.errs,
+	}
+}
+
+func (j *Job) formatDone() {
+	j.mu.Lock()
+	j.done++
+	j.mu.Unlock()
+}
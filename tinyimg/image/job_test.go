@@ -0,0 +1,165 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dunkbing/tinyimg/tinyimg/config"
+	"github.com/dunkbing/tinyimg/tinyimg/utils"
+)
+
+// fakeEncoder stands in for pngquant and cwebp: it copies its input to the
+// file given by -o or --output, so every output has the content of the input
+// it was made from.
+const fakeEncoder = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-o|--output) out="$2"; shift ;;
+	-*) ;;
+	*) in="$1" ;;
+	esac
+	shift
+done
+cp "$in" "$out"
+`
+
+func TestMain(m *testing.M) {
+	home, err := os.MkdirTemp("", "tinyimg-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// the default directories are under the home directory
+	os.Setenv("HOME", home)
+	// every encode of the stress test may wait for a worker
+	file := filepath.Join(home, "config.toml")
+	if err = os.WriteFile(file, []byte("[poolOpt]\nqueueDepth = 1024\n"), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err = config.Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"--config", file}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// newTestFileManager returns a FileManager whose encoders are fakeEncoder.
+func newTestFileManager(t *testing.T) *FileManager {
+	t.Helper()
+	tool := filepath.Join(t.TempDir(), "encoder")
+	if err := os.WriteFile(tool, []byte(fakeEncoder), 0755); err != nil {
+		t.Fatal(err)
+	}
+	utils.SetToolPaths(map[string]string{"pngquant": tool, "cwebp": tool})
+	t.Cleanup(func() { utils.SetToolPaths(nil) })
+	fm, err := NewFileManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fm
+}
+
+// newTestFile writes a distinct PNG for n to the input directory.
+func newTestFile(t *testing.T, n int, formats []string) (*File, []byte) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(0, 0, color.RGBA{R: uint8(n), G: uint8(n >> 8), B: 1, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	name := hex.EncodeToString(sum[:]) + ".png"
+	dest := filepath.Join(config.GetConfig().App.InDir, name)
+	if err := os.WriteFile(dest, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &File{
+		Ext:           "png",
+		MimeType:      "image/png",
+		Name:          name,
+		Size:          int64(buf.Len()),
+		InputFileDest: dest,
+		Formats:       formats,
+	}, buf.Bytes()
+}
+
+// TestConcurrentJobs converts many distinct images at once and checks that
+// no job sees the results or outputs of another. Run it with -race.
+func TestConcurrentJobs(t *testing.T) {
+	fm := newTestFileManager(t)
+	formats := []string{"png", "webp"}
+	const n = 64
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		file, content := newTestFile(t, i, formats)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.Background()
+			job, err := fm.HandleFile(ctx, file)
+			if err != nil {
+				t.Errorf("%s: %v", file.Name, err)
+				return
+			}
+			results, files, errs := job.Convert(ctx)
+			if len(errs) > 0 {
+				t.Errorf("%s: %v", file.Name, errs)
+				return
+			}
+			checkOutputs(t, fm, file, content, results, files)
+			if state := job.State(); state.Status != JobDone || state.Progress.Done != len(formats) {
+				t.Errorf("%s: state %+v", file.Name, state)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// checkOutputs checks that every result and output file of a conversion of
+// file belongs to it.
+func checkOutputs(t *testing.T, fm *FileManager, file *File, content []byte, results []CompressResult, files []string) {
+	base := strings.TrimSuffix(file.Name, ".png")
+	for i, format := range file.Formats {
+		r, name := results[i], files[i]
+		if r.Format != format {
+			t.Errorf("%s: result %d is %s, want %s", file.Name, i, r.Format, format)
+		}
+		if !strings.HasPrefix(name, base+"-") || !strings.HasSuffix(name, "."+format) {
+			t.Errorf("%s: output %s belongs to another input", file.Name, name)
+		}
+		if !strings.HasSuffix(r.ImageUrl, "f="+name) {
+			t.Errorf("%s: url %s doesn't point to %s", file.Name, r.ImageUrl, name)
+		}
+		if r.NewSize != file.Size {
+			t.Errorf("%s: new size %d, want %d", file.Name, r.NewSize, file.Size)
+		}
+		rc, _, err := fm.Storage().Get(context.Background(), name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: content of another input", name)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package image
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/dunkbing/tinyimg/tinyimg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ZipManifest is added as manifest.json to downloaded archives.
+type ZipManifest struct {
+	Files   []ZipEntry `json:"files"`
+	Missing []string   `json:"missing"`
+}
+
+// ZipEntry describes a file of a downloaded archive. Result is set when the
+// conversion that produced the file is still cached.
+type ZipEntry struct {
+	Name   string          `json:"name"`
+	Size   int64           `json:"size"`
+	Result *CompressResult `json:"result,omitempty"`
+}
+
+// ZipName returns a file name for the archive of the given files.
+func ZipName(files []string) string {
+	var concatenatedNames string
+	for _, file := range files {
+		concatenatedNames += filepath.Base(file)
+	}
+	hash := md5.Sum([]byte(concatenatedNames))
+	return hex.EncodeToString(hash[:]) + ".zip"
+}
+
+// MissingFiles returns the given converted files that are not in storage.
+func (fm *FileManager) MissingFiles(ctx context.Context, files []string) []string {
+	var missing []string
+	for _, file := range files {
+		if _, err := fm.storage.Stat(ctx, file); err != nil {
+			missing = append(missing, file)
+		}
+	}
+	return missing
+}
+
+// ZipFiles streams a zip archive of the given converted files to w, using
+// zip.Store or zip.Deflate. Files that can't be read are listed as missing
+// in the archive's manifest.json, which is also returned. An error means
+// writing to w failed and the archive is incomplete.
+func (fm *FileManager) ZipFiles(ctx context.Context, w io.Writer, files []string, method uint16) (manifest *ZipManifest, err error) {
+	ctx, span := tracing.Start(ctx, "ZipFiles",
+		attribute.Int("files", len(files)),
+		attribute.Int("zip.method", int(method)),
+	)
+	defer func() {
+		if manifest != nil {
+			span.SetAttributes(attribute.Int("files.missing", len(manifest.Missing)))
+		}
+		tracing.End(span, err)
+	}()
+	logger.Info("zipping files", "files", files)
+	t := time.Now()
+	manifest = &ZipManifest{Files: []ZipEntry{}, Missing: []string{}}
+
+	zipWriter := zip.NewWriter(w)
+	for _, file := range files {
+		entry, err := fm.zipFile(ctx, zipWriter, file, method)
+		if errors.Is(err, errZipWrite) {
+			return manifest, err
+		}
+		if err != nil {
+			logger.Info("file missing from zip", "file", file, "err", err)
+			manifest.Missing = append(manifest.Missing, file)
+			continue
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     "manifest.json",
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return manifest, err
+	}
+	if err = json.NewEncoder(writer).Encode(manifest); err != nil {
+		return manifest, err
+	}
+	if err = zipWriter.Close(); err != nil {
+		return manifest, err
+	}
+
+	nt := time.Since(t).Milliseconds()
+	logger.Info("zipped files", "files", len(manifest.Files), "missing", len(manifest.Missing), "time", nt)
+	return manifest, nil
+}
+
+// errZipWrite wraps failures to write the archive, as opposed to failures to
+// read one of its files.
+var errZipWrite = errors.New("writing zip")
+
+func (fm *FileManager) zipFile(ctx context.Context, zipWriter *zip.Writer, filename string, method uint16) (ZipEntry, error) {
+	f, info, err := fm.storage.Get(ctx, filename)
+	if err != nil {
+		return ZipEntry{}, err
+	}
+	defer f.Close()
+
+	header := &zip.FileHeader{
+		Name:     filepath.Base(filename),
+		Method:   method,
+		Modified: info.ModTime,
+	}
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return ZipEntry{}, errors.Join(errZipWrite, err)
+	}
+	if _, err = io.Copy(writer, f); err != nil {
+		// a partial entry can't be taken back
+		return ZipEntry{}, errors.Join(errZipWrite, err)
+	}
+
+	entry := ZipEntry{Name: header.Name, Size: info.Size}
+	if res, ok := fm.cache.Get(filename); ok {
+		entry.Result = &res
+	}
+	return entry, nil
+}
@@ -0,0 +1,371 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dunkbing/tinyimg/tinyimg/metrics"
+)
+
+// Policy is the retention policy of a directory. Files are evicted when they
+// haven't been accessed for TTL, and the least recently accessed files are
+// evicted while the directory holds more than MaxBytes. A zero value
+// disables that rule.
+type Policy struct {
+	Dir      string        `json:"dir"`
+	TTL      time.Duration `json:"ttl"`
+	MaxBytes int64         `json:"maxBytes"`
+}
+
+// Options represent the janitor configuration.
+type Options struct {
+	Interval time.Duration `json:"interval"`
+	// DryRun logs what would be evicted without removing anything. The stats
+	// then report what the last sweep would have reclaimed.
+	DryRun   bool     `json:"dryRun"`
+	Policies []Policy `json:"policies"`
+}
+
+// Object is an object of a Store.
+type Object struct {
+	Key        string
+	Size       int64
+	LastAccess time.Time
+}
+
+// Store is an object store swept along with the directory of a policy, e.g.
+// the bucket the converted images are uploaded to.
+type Store interface {
+	List(ctx context.Context) ([]Object, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Janitor periodically evicts files from directories according to their
+// policies. The last access time of a file is its modification time, which
+// readers refresh with Touch. A file and its ".info" sidecar, like a tus
+// upload and its state, are evicted together.
+type Janitor struct {
+	opts   Options
+	logger *slog.Logger
+	stores map[string]Store
+
+	mu    sync.Mutex
+	stats map[string]*dirStats
+}
+
+// dirStats are the eviction stats of a directory. In dry-run mode
+// BytesReclaimed and FilesRemoved are what the last sweep would have
+// evicted, as nothing is.
+type dirStats struct {
+	BytesReclaimed int64     `json:"bytesReclaimed"`
+	FilesRemoved   int64     `json:"filesRemoved"`
+	Bytes          int64     `json:"bytes"`
+	Files          int64     `json:"files"`
+	LastRun        time.Time `json:"lastRun"`
+}
+
+type entry struct {
+	path       string
+	sidecar    string
+	size       int64
+	lastAccess time.Time
+}
+
+// sidecarExt is the extension of the files kept and evicted with the file
+// they are named after.
+const sidecarExt = ".info"
+
+// New creates a Janitor with the given options.
+func New(o *Options) *Janitor {
+	j := &Janitor{
+		opts:   *o,
+		logger: slog.Default(),
+		stores: make(map[string]Store),
+		stats:  make(map[string]*dirStats),
+	}
+	for _, p := range o.Policies {
+		j.stats[p.Dir] = &dirStats{}
+	}
+	return j
+}
+
+// Touch marks a file as accessed now.
+func Touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// SetStore makes the policy of dir sweep the objects of s as well as the
+// files of dir, which still holds temporary files and the leftovers of
+// failed uploads. The policy applies to each of them separately. It must be
+// called before Start.
+func (j *Janitor) SetStore(dir string, s Store) {
+	j.stores[dir] = s
+}
+
+// Start runs a sweep every interval in the background and publishes the
+// janitor stats under /debug/vars.
+func (j *Janitor) Start() {
+	if expvar.Get("janitor") == nil {
+		expvar.Publish("janitor", expvar.Func(func() any { return j.Stats() }))
+	}
+	go func() {
+		for {
+			j.Sweep()
+			time.Sleep(j.opts.Interval)
+		}
+	}()
+}
+
+// Stats returns the eviction stats of every directory.
+func (j *Janitor) Stats() map[string]dirStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	stats := make(map[string]dirStats, len(j.stats))
+	for dir, s := range j.stats {
+		stats[dir] = *s
+	}
+	return stats
+}
+
+// Sweep applies every policy once.
+func (j *Janitor) Sweep() {
+	for _, p := range j.opts.Policies {
+		if err := j.sweep(p); err != nil {
+			j.logger.Error("janitor sweep failed", "dir", p.Dir, "err", err)
+		}
+	}
+}
+
+// sweepResult is what a sweep evicted from a directory or a store and what
+// it kept.
+type sweepResult struct {
+	reclaimed, removed int64
+	bytes, files       int64
+}
+
+func (r sweepResult) add(o sweepResult) sweepResult {
+	return sweepResult{
+		reclaimed: r.reclaimed + o.reclaimed,
+		removed:   r.removed + o.removed,
+		bytes:     r.bytes + o.bytes,
+		files:     r.files + o.files,
+	}
+}
+
+func (j *Janitor) sweep(p Policy) error {
+	ctx := context.Background()
+	now := time.Now()
+	entries, dirs, err := j.scan(p.Dir)
+	if err != nil {
+		return err
+	}
+	res := j.evict(ctx, p, nil, entries, now)
+	if !j.opts.DryRun && p.TTL > 0 {
+		j.removeEmptyDirs(dirs, now.Add(-p.TTL))
+	}
+	if store := j.stores[p.Dir]; store != nil {
+		var objects []entry
+		if objects, err = list(ctx, store); err == nil {
+			res = res.add(j.evict(ctx, p, store, objects, now))
+		}
+	}
+	if res.removed > 0 {
+		j.logger.Info("janitor swept", "dir", p.Dir, "removed", res.removed, "reclaimed", res.reclaimed, "dryRun", j.opts.DryRun)
+	}
+
+	j.mu.Lock()
+	s := j.stats[p.Dir]
+	if j.opts.DryRun {
+		// the same files would be counted again by every sweep
+		s.BytesReclaimed, s.FilesRemoved = res.reclaimed, res.removed
+	} else {
+		s.BytesReclaimed += res.reclaimed
+		s.FilesRemoved += res.removed
+	}
+	s.Bytes = res.bytes
+	s.Files = res.files
+	s.LastRun = now
+	j.mu.Unlock()
+
+	metrics.JanitorBytes.WithLabelValues(p.Dir).Set(float64(res.bytes))
+	metrics.JanitorFiles.WithLabelValues(p.Dir).Set(float64(res.files))
+	if j.opts.DryRun {
+		metrics.JanitorReclaimableBytes.WithLabelValues(p.Dir).Set(float64(res.reclaimed))
+		metrics.JanitorReclaimableFiles.WithLabelValues(p.Dir).Set(float64(res.removed))
+	} else {
+		metrics.JanitorReclaimedBytes.WithLabelValues(p.Dir).Add(float64(res.reclaimed))
+		metrics.JanitorRemovedFiles.WithLabelValues(p.Dir).Add(float64(res.removed))
+	}
+	return err
+}
+
+// evict applies p to entries, which are objects of s or files when s is
+// nil, and removes the expired ones and the least recently accessed ones
+// over MaxBytes.
+func (j *Janitor) evict(ctx context.Context, p Policy, s Store, entries []entry, now time.Time) sweepResult {
+	var evict, keep []entry
+	var total int64
+	for _, e := range entries {
+		if p.TTL > 0 && now.Sub(e.lastAccess) > p.TTL {
+			evict = append(evict, e)
+			continue
+		}
+		keep = append(keep, e)
+		total += e.size
+	}
+	if p.MaxBytes > 0 && total > p.MaxBytes {
+		sort.Slice(keep, func(a, b int) bool {
+			return keep[a].lastAccess.Before(keep[b].lastAccess)
+		})
+		for len(keep) > 0 && total > p.MaxBytes {
+			evict = append(evict, keep[0])
+			total -= keep[0].size
+			keep = keep[1:]
+		}
+	}
+
+	res := sweepResult{bytes: total, files: int64(len(keep))}
+	for _, e := range evict {
+		if j.opts.DryRun {
+			j.logger.Info("janitor would remove", "path", e.path, "size", e.size, "lastAccess", e.lastAccess)
+		} else if err := remove(ctx, s, e); err != nil {
+			j.logger.Error("janitor failed to remove", "path", e.path, "err", err)
+			continue
+		}
+		res.reclaimed += e.size
+		res.removed++
+	}
+	if j.opts.DryRun {
+		// nothing was removed
+		res.bytes += res.reclaimed
+		res.files += res.removed
+	}
+	return res
+}
+
+// list returns the objects of a store as entries keyed by path.
+func list(ctx context.Context, s Store) ([]entry, error) {
+	objects, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]entry, len(objects))
+	for i, o := range objects {
+		entries[i] = entry{path: o.Key, size: o.Size, lastAccess: o.LastAccess}
+	}
+	return entries, nil
+}
+
+// remove evicts e, an object of s or a file when s is nil. The sidecar of a
+// file goes first, so a failure never leaves it describing missing data.
+// Entries that are already gone are not an error.
+func remove(ctx context.Context, s Store, e entry) error {
+	if s != nil {
+		return s.Delete(ctx, e.path)
+	}
+	for _, path := range []string{e.sidecar, e.path} {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan lists the files and subdirectories of dir, skipping subdirectories
+// that have a policy of their own. A sidecar is merged into the entry of its
+// file: their sizes add up and the latest access counts.
+func (j *Janitor) scan(dir string) ([]entry, []string, error) {
+	var (
+		entries []entry
+		dirs    []string
+	)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path == dir {
+				return nil
+			}
+			if j.hasPolicy(path) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, entry{path: path, size: info.Size(), lastAccess: info.ModTime()})
+		return nil
+	})
+	return mergeSidecars(entries), dirs, err
+}
+
+func mergeSidecars(entries []entry) []entry {
+	files := make(map[string]int, len(entries))
+	for i, e := range entries {
+		files[e.path] = i
+	}
+	sidecars := map[string]bool{}
+	for _, e := range entries {
+		i, ok := files[strings.TrimSuffix(e.path, sidecarExt)]
+		if !ok || !strings.HasSuffix(e.path, sidecarExt) {
+			continue
+		}
+		f := &entries[i]
+		f.sidecar = e.path
+		f.size += e.size
+		if e.lastAccess.After(f.lastAccess) {
+			f.lastAccess = e.lastAccess
+		}
+		sidecars[e.path] = true
+	}
+	merged := make([]entry, 0, len(entries)-len(sidecars))
+	for _, e := range entries {
+		if !sidecars[e.path] {
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+func (j *Janitor) hasPolicy(dir string) bool {
+	for _, p := range j.opts.Policies {
+		if filepath.Clean(p.Dir) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEmptyDirs removes the empty directories left behind by evictions,
+// e.g. yt-dlp download directories, deepest first. Directories modified
+// after cutoff are kept as they may be in use.
+func (j *Janitor) removeEmptyDirs(dirs []string, cutoff time.Time) {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(dirs[i])
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		// Remove fails on directories that are not empty
+		_ = os.Remove(dirs[i])
+	}
+}
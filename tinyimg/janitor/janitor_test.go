@@ -0,0 +1,155 @@
+package janitor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is a Store keeping its objects in memory.
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string]Object
+}
+
+func (m *memStore) List(context.Context) ([]Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var objects []Object
+	for _, o := range m.objects {
+		objects = append(objects, o)
+	}
+	return objects, nil
+}
+
+func (m *memStore) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memStore) keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestSweepStore(t *testing.T) {
+	now := time.Now()
+	store := &memStore{objects: map[string]Object{
+		"old.webp":    {Key: "old.webp", Size: 10, LastAccess: now.Add(-2 * time.Hour)},
+		"older.webp":  {Key: "older.webp", Size: 10, LastAccess: now.Add(-50 * time.Minute)},
+		"recent.webp": {Key: "recent.webp", Size: 10, LastAccess: now},
+	}}
+	dir := t.TempDir()
+	// the directory is swept too, e.g. for the leftovers of failed uploads
+	local := filepath.Join(dir, "failed.webp")
+	if err := os.WriteFile(local, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := now.Add(-2 * time.Hour)
+	os.Chtimes(local, old, old)
+	uploading := filepath.Join(dir, "uploading.webp")
+	if err := os.WriteFile(uploading, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := New(&Options{Policies: []Policy{{Dir: dir, TTL: time.Hour, MaxBytes: 10}}})
+	j.SetStore(dir, store)
+	j.Sweep()
+
+	if keys := store.keys(); len(keys) != 1 || keys[0] != "recent.webp" {
+		t.Fatalf("kept %v, want [recent.webp]", keys)
+	}
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Fatalf("expired file of the directory was kept: %v", err)
+	}
+	// the size limit applies to the directory and the store separately
+	if _, err := os.Stat(uploading); err != nil {
+		t.Fatalf("recent file of the directory was removed: %v", err)
+	}
+	s := j.Stats()[dir]
+	if s.FilesRemoved != 3 || s.BytesReclaimed != 21 || s.Files != 2 || s.Bytes != 11 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestSweepDryRun(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"a.png", "b.png"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("12345"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, old, old)
+	}
+
+	j := New(&Options{DryRun: true, Policies: []Policy{{Dir: dir, TTL: time.Hour}}})
+	for i := 0; i < 3; i++ {
+		j.Sweep()
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Fatalf("dry run removed files, %d left", len(entries))
+	}
+	// every sweep reports the same files, they are not added up
+	s := j.Stats()[dir]
+	if s.FilesRemoved != 2 || s.BytesReclaimed != 10 || s.Files != 2 || s.Bytes != 10 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestSweepSidecars(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(name string, size int, lastAccess time.Time) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, lastAccess, lastAccess)
+		return path
+	}
+	// an upload whose data is old but whose state was just written is kept
+	active := write("active", 10, now.Add(-2*time.Hour))
+	activeInfo := write("active.info", 1, now)
+	// the data of an expired upload goes with its state
+	expired := write("expired", 1, now.Add(-2*time.Hour))
+	expiredInfo := write("expired.info", 1, now.Add(-2*time.Hour))
+	// a completed upload only has its state left
+	completed := write("completed.info", 1, now.Add(-2*time.Hour))
+	// the least recently used upload goes over the size limit, as a whole
+	large := write("large", 8, now.Add(-30*time.Minute))
+	largeInfo := write("large.info", 1, now.Add(-30*time.Minute))
+
+	j := New(&Options{Policies: []Policy{{Dir: dir, TTL: time.Hour, MaxBytes: 15}}})
+	j.Sweep()
+
+	for _, path := range []string{active, activeInfo} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", filepath.Base(path), err)
+		}
+	}
+	for _, path := range []string{expired, expiredInfo, completed, large, largeInfo} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was kept", filepath.Base(path))
+		}
+	}
+	s := j.Stats()[dir]
+	if s.FilesRemoved != 3 || s.BytesReclaimed != 12 || s.Files != 1 || s.Bytes != 11 {
+		t.Fatalf("stats %+v", s)
+	}
+}
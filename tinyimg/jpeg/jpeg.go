@@ -2,19 +2,26 @@ package jpeg
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"github.com/dunkbing/tinyimg/tinyimg/utils"
 	"image"
 	"image/jpeg"
 	"io"
 	"log/slog"
-	"os/exec"
+	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Options represent JPEG encoding options.
 type Options struct {
-	Quality int `json:"quality"`
+	Quality int           `json:"quality"`
+	Timeout time.Duration `json:"timeout"`
+	// KeepMetadata keeps the EXIF, XMP and ICC data of the input.
+	KeepMetadata bool `json:"keepMetadata"`
 }
 
 // DecodeJPEG decodes a JPEG file and return an image.
@@ -36,33 +43,45 @@ func EncodeJPEG(i image.Image, o *Options) (buf bytes.Buffer, err error) {
 	return buf, err
 }
 
-func Encode(inputFile, outDir string) (string, error) {
+// Encode compresses inputFile into a JPEG in outDir. The encoders are killed
+// and partial outputs removed when ctx is done or the timeout expires.
+func Encode(ctx context.Context, inputFile, outDir string, o *Options) (string, error) {
 	slog.Info("Encode JPEG", "inputFile", inputFile)
+	if o.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+
 	if !isJpeg(inputFile) {
 		newInputFile := strings.Replace(inputFile, path.Ext(inputFile), ".jpg", 1)
-		convertCmd := exec.Command(
-			"vips", "copy",
-			inputFile, fmt.Sprintf("%s[Q=80]", newInputFile),
+		err := utils.RunCommand(
+			ctx, "vips", "copy",
+			inputFile, fmt.Sprintf("%s[Q=%d]", newInputFile, o.Quality),
 		)
-		err := convertCmd.Run()
 		if err != nil {
 			slog.Error("convert to jpg error", "err", err)
+			_ = os.Remove(newInputFile)
 			return "", err
 		}
 		inputFile = newInputFile
 	}
 
-	cmd := exec.Command(
-		"jpegoptim",
-		"--strip-all",
-		"-o", "-m", "80",
+	strip := "--strip-all"
+	if o.KeepMetadata {
+		strip = "--strip-none"
+	}
+	outputFile := path.Join(outDir, path.Base(inputFile))
+	err := utils.RunCommand(
+		ctx, "jpegoptim",
+		strip,
+		"-o", "-m", strconv.Itoa(o.Quality),
 		inputFile, "-d", outDir,
 	)
-	err := cmd.Run()
 	if err != nil {
+		_ = os.Remove(outputFile)
 		return "", err
 	}
-	outputFile := path.Join(outDir, path.Base(inputFile))
 	return outputFile, nil
 }
 
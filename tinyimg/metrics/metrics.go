@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes every metric.
+const namespace = "tinyimg"
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// ConversionDuration observes how long encoding an image into a format
+	// takes, waiting for a worker included.
+	ConversionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "conversion_duration_seconds",
+		Help:      "Duration of image conversions by output format.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"format"})
+	// SizeRatio observes the size of converted images relative to their
+	// original.
+	SizeRatio = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "conversion_size_ratio",
+		Help:      "Output size divided by input size by output format.",
+		Buckets:   prometheus.LinearBuckets(0.1, 0.1, 12),
+	}, []string{"format"})
+	// ToolFailures counts the failed runs of external tools. The exit code
+	// is "canceled" or "timeout" when the tool was killed and "start" when
+	// it could not be started.
+	ToolFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tool_failures_total",
+		Help:      "Failed runs of external tools by tool and exit code.",
+	}, []string{"tool", "exit_code"})
+	// LimiterRejections counts the requests rejected by the rate limiter.
+	LimiterRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "limiter_rejections_total",
+		Help:      "Requests rejected by the rate limiter.",
+	})
+
+	// JanitorBytes and JanitorFiles are what the janitor keeps in each
+	// directory after its last sweep.
+	JanitorBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "janitor_bytes",
+		Help:      "Bytes kept in a directory after the last janitor sweep.",
+	}, []string{"dir"})
+	JanitorFiles = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "janitor_files",
+		Help:      "Files kept in a directory after the last janitor sweep.",
+	}, []string{"dir"})
+	// JanitorReclaimedBytes and JanitorRemovedFiles count what the janitor
+	// evicted from each directory.
+	JanitorReclaimedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "janitor_reclaimed_bytes_total",
+		Help:      "Bytes evicted from a directory by the janitor.",
+	}, []string{"dir"})
+	JanitorRemovedFiles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "janitor_removed_files_total",
+		Help:      "Files evicted from a directory by the janitor.",
+	}, []string{"dir"})
+	// JanitorReclaimableBytes and JanitorReclaimableFiles are what the last
+	// dry-run sweep of each directory would have evicted.
+	JanitorReclaimableBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "janitor_reclaimable_bytes",
+		Help:      "Bytes the last dry-run janitor sweep would have evicted from a directory.",
+	}, []string{"dir"})
+	JanitorReclaimableFiles = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "janitor_reclaimable_files",
+		Help:      "Files the last dry-run janitor sweep would have evicted from a directory.",
+	}, []string{"dir"})
+)
+
+// Handler serves the metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// GaugeFunc registers a gauge whose value is read from fn when scraped.
+// Registering a name again is a no-op.
+func GaugeFunc(name, help string, fn func() float64) error {
+	return register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// CounterFunc registers a counter whose value is read from fn when scraped.
+// Registering a name again is a no-op.
+func CounterFunc(name, help string, fn func() float64) error {
+	return register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// register registers c with the default registry. A collector that is
+// already registered is not an error.
+func register(c prometheus.Collector) error {
+	err := prometheus.Register(c)
+	var are prometheus.AlreadyRegisteredError
+	if err != nil && !errors.As(err, &are) {
+		return fmt.Errorf("registering metric: %w", err)
+	}
+	return nil
+}
+
+// Instrument counts the requests handled by next and observes their
+// latency under route, usually the pattern next is registered with.
+func Instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(t).Seconds())
+		requests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// statusRecorder remembers the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
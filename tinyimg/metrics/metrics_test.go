@@ -0,0 +1,18 @@
+package metrics
+
+import "testing"
+
+func TestRegisterFuncs(t *testing.T) {
+	one := func() float64 { return 1 }
+	if err := GaugeFunc("test_gauge", "A test gauge.", one); err != nil {
+		t.Fatal(err)
+	}
+	// registering the same metric again is a no-op
+	if err := GaugeFunc("test_gauge", "A test gauge.", one); err != nil {
+		t.Fatal(err)
+	}
+	// a name taken by another kind of metric is an error
+	if err := CounterFunc("test_gauge", "A test counter.", one); err == nil {
+		t.Fatal("registered a counter under the name of a gauge")
+	}
+}
@@ -2,14 +2,17 @@ package png
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"github.com/dunkbing/tinyimg/tinyimg/utils"
 	"image"
 	"image/png"
 	"io"
 	"log/slog"
-	"os/exec"
+	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/foobaz/lossypng/lossypng"
 )
@@ -18,7 +21,10 @@ const qMax = 20
 
 // Options represent PNG encoding options.
 type Options struct {
-	Quality int `json:"quality"`
+	Quality int           `json:"quality"`
+	Timeout time.Duration `json:"timeout"`
+	// KeepMetadata keeps the text chunks and ICC profile of the input.
+	KeepMetadata bool `json:"keepMetadata"`
 }
 
 // DecodePNG decodes a PNG file and return an image.
@@ -38,18 +44,27 @@ func EncodePNG(i image.Image, o *Options) (buf bytes.Buffer, err error) {
 	return buf, err
 }
 
-func Encode(inputFile, outDir string) (string, error) {
+// Encode compresses inputFile into a PNG in outDir. The encoders are killed
+// and partial outputs removed when ctx is done or the timeout expires.
+func Encode(ctx context.Context, inputFile, outDir string, o *Options) (string, error) {
 	slog.Info("Encode PNG", "inputFile", inputFile)
+	if o.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+
 	filename := path.Base(inputFile)
 	if !isPng(inputFile) {
 		newInputFile := strings.Replace(inputFile, path.Ext(inputFile), ".png", 1)
-		convertCmd := exec.Command(
-			"vips", "copy",
-			inputFile, fmt.Sprintf("%s[strip]", newInputFile),
-		)
-		err := convertCmd.Run()
+		target := newInputFile
+		if !o.KeepMetadata {
+			target += "[strip]"
+		}
+		err := utils.RunCommand(ctx, "vips", "copy", inputFile, target)
 		if err != nil {
 			slog.Error("convert to png error", "err", err)
+			_ = os.Remove(newInputFile)
 			return "", err
 		}
 		inputFile = newInputFile
@@ -57,15 +72,19 @@ func Encode(inputFile, outDir string) (string, error) {
 	outputFile := path.Join(outDir, filename)
 	outputFile = strings.Replace(outputFile, path.Ext(outputFile), ".png", 1)
 
-	cmd := exec.Command(
-		"pngquant", "--quality=0-80",
+	args := []string{
+		fmt.Sprintf("--quality=0-%d", o.Quality),
 		"--speed=4", inputFile,
 		"--output", outputFile,
-		"--force", "--strip",
-	)
-	err := cmd.Run()
+		"--force",
+	}
+	if !o.KeepMetadata {
+		args = append(args, "--strip")
+	}
+	err := utils.RunCommand(ctx, "pngquant", args...)
 	if err != nil {
-		slog.Error("pngquant error", "err", err, "command", cmd.String())
+		slog.Error("pngquant error", "err", err)
+		_ = os.Remove(outputFile)
 		return "", err
 	}
 
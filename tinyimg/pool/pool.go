@@ -0,0 +1,136 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrQueueFull is returned when no worker is free and the wait queue is full.
+var ErrQueueFull = errors.New("encoder queue is full")
+
+// Options represent the limits of the encoder worker pool.
+type Options struct {
+	// MaxWorkers is the number of external encoder processes that may run at
+	// the same time across all encoders.
+	MaxWorkers int `json:"maxWorkers"`
+	// PerEncoder limits the processes of a single encoder, keyed by format.
+	// Encoders without an entry are only bound by MaxWorkers.
+	PerEncoder map[string]int `json:"perEncoder"`
+	// QueueDepth is the number of encodes that may wait for a free worker
+	// before new ones are rejected.
+	QueueDepth int `json:"queueDepth"`
+	// RetryAfter is the number of seconds clients are told to wait when the
+	// queue is full.
+	RetryAfter int `json:"retryAfter"`
+}
+
+// Pool bounds the number of encoder processes running concurrently.
+type Pool struct {
+	global   chan struct{}
+	encoders map[string]chan struct{}
+
+	queueDepth int64
+	queued     atomic.Int64
+	running    atomic.Int64
+}
+
+// New creates a new Pool with the given limits.
+func New(o *Options) *Pool {
+	p := &Pool{
+		global:     make(chan struct{}, max(o.MaxWorkers, 1)),
+		encoders:   make(map[string]chan struct{}),
+		queueDepth: int64(max(o.QueueDepth, 0)),
+	}
+	for encoder, limit := range o.PerEncoder {
+		if limit > 0 {
+			p.encoders[encoder] = make(chan struct{}, limit)
+		}
+	}
+	return p
+}
+
+// Acquire reserves a worker for the given encoder, waiting in the queue if
+// none is free, until ctx is done. The returned function must be called to
+// release the worker.
+func (p *Pool) Acquire(ctx context.Context, encoder string) (release func(), err error) {
+	sem := p.encoders[encoder]
+	if p.tryAcquire(sem) {
+		return p.releaser(sem), nil
+	}
+
+	if p.queued.Add(1) > p.queueDepth {
+		p.queued.Add(-1)
+		return nil, ErrQueueFull
+	}
+	defer p.queued.Add(-1)
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	select {
+	case p.global <- struct{}{}:
+	case <-ctx.Done():
+		if sem != nil {
+			<-sem
+		}
+		return nil, ctx.Err()
+	}
+	p.running.Add(1)
+
+	return p.releaser(sem), nil
+}
+
+// Full reports whether new encodes would be rejected.
+func (p *Pool) Full() bool {
+	return len(p.global) == cap(p.global) && p.queued.Load() >= p.queueDepth
+}
+
+// Stats is the state of a Pool.
+type Stats struct {
+	Capacity int   `json:"capacity"`
+	Running  int64 `json:"running"`
+	Queued   int64 `json:"queued"`
+}
+
+// Stats returns the current state of the pool.
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Capacity: cap(p.global),
+		Running:  p.running.Load(),
+		Queued:   p.queued.Load(),
+	}
+}
+
+func (p *Pool) tryAcquire(sem chan struct{}) bool {
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	select {
+	case p.global <- struct{}{}:
+		p.running.Add(1)
+		return true
+	default:
+		if sem != nil {
+			<-sem
+		}
+		return false
+	}
+}
+
+func (p *Pool) releaser(sem chan struct{}) func() {
+	return func() {
+		p.running.Add(-1)
+		<-p.global
+		if sem != nil {
+			<-sem
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// acquired reports whether Acquire returns within a short time.
+func acquired(p *Pool, encoder string) (func(), bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	release, err := p.Acquire(ctx, encoder)
+	return release, err == nil
+}
+
+func TestGlobalLimit(t *testing.T) {
+	p := New(&Options{MaxWorkers: 2, QueueDepth: 10})
+	r1, _ := acquired(p, "png")
+	r2, _ := acquired(p, "webp")
+	if _, ok := acquired(p, "jpg"); ok {
+		t.Fatal("acquired a third worker of two")
+	}
+	r1()
+	r3, ok := acquired(p, "jpg")
+	if !ok {
+		t.Fatal("released worker was not reused")
+	}
+	r2()
+	r3()
+	if s := p.Stats(); s.Running != 0 || s.Queued != 0 || s.Capacity != 2 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestPerEncoderLimit(t *testing.T) {
+	p := New(&Options{MaxWorkers: 4, PerEncoder: map[string]int{"png": 1}, QueueDepth: 10})
+	release, _ := acquired(p, "png")
+	if _, ok := acquired(p, "png"); ok {
+		t.Fatal("acquired a second png worker of one")
+	}
+	// other encoders are only bound by the global limit
+	for i := 0; i < 3; i++ {
+		if _, ok := acquired(p, "webp"); !ok {
+			t.Fatalf("webp worker %d refused", i)
+		}
+	}
+	release()
+	if _, ok := acquired(p, "webp"); !ok {
+		t.Fatal("released png worker was not reused by webp")
+	}
+	// the png slot is free but every global worker is taken
+	if _, ok := acquired(p, "png"); ok {
+		t.Fatal("acquired a png worker past the global limit")
+	}
+	// a png waiting for a global worker gave its png slot back
+	if len(p.encoders["png"]) != 0 {
+		t.Fatal("png slot leaked by a canceled wait")
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	p := New(&Options{MaxWorkers: 1, QueueDepth: 1})
+	release, _ := acquired(p, "png")
+
+	// one encode may wait, the next one is rejected at once
+	waited := make(chan error)
+	go func() {
+		r, err := p.Acquire(context.Background(), "png")
+		if err == nil {
+			r()
+		}
+		waited <- err
+	}()
+	for p.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if !p.Full() {
+		t.Fatal("pool with a full queue is not full")
+	}
+	if _, err := p.Acquire(context.Background(), "png"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("acquire on a full queue = %v, want %v", err, ErrQueueFull)
+	}
+
+	release()
+	if err := <-waited; err != nil {
+		t.Fatalf("queued encode failed: %v", err)
+	}
+	if s := p.Stats(); s.Running != 0 || s.Queued != 0 || p.Full() {
+		t.Fatalf("stats %+v after every release", s)
+	}
+}
+
+func TestCanceledWait(t *testing.T) {
+	p := New(&Options{MaxWorkers: 1, PerEncoder: map[string]int{"png": 1}, QueueDepth: 4})
+	release, _ := acquired(p, "webp")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := p.Acquire(ctx, "png")
+		done <- err
+	}()
+	for p.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled acquire = %v", err)
+	}
+	if s := p.Stats(); s.Queued != 0 || s.Running != 1 {
+		t.Fatalf("stats %+v after a canceled wait", s)
+	}
+
+	// the canceled wait released its png slot
+	release()
+	r, ok := acquired(p, "png")
+	if !ok {
+		t.Fatal("png worker refused after a canceled wait")
+	}
+	r()
+}
@@ -0,0 +1,139 @@
+package ratelimit
+
+// The memory limiter was yanked from here: https://www.alexedwards.net/blog/how-to-rate-limit-http-requests
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limit is the rate a client may sustain, in requests per second, and the
+// number of requests it may send at once.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Limiter decides whether a client, identified by key, may make a request.
+// The limit is given on every call so that it can be reloaded. When a
+// request is refused, the returned duration is how long the client should
+// wait before retrying.
+type Limiter interface {
+	Allow(ctx context.Context, key string, l Limit) (bool, time.Duration, error)
+}
+
+// visitor is the token bucket of a client and the last time it was seen.
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Memory is a Limiter keeping a token bucket per client in memory. Each
+// process has its own buckets.
+type Memory struct {
+	mu       sync.Mutex
+	visitors map[string]*visitor
+}
+
+// NewMemory creates a Memory limiter. Clients that haven't been seen for 3
+// minutes are forgotten.
+func NewMemory() *Memory {
+	m := &Memory{visitors: make(map[string]*visitor)}
+	go m.cleanup()
+	return m
+}
+
+// Allow takes a token from the bucket of key.
+func (m *Memory) Allow(_ context.Context, key string, l Limit) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.visitors[key]
+	if !ok {
+		v = &visitor{limiter: rate.NewLimiter(rate.Limit(l.Rate), l.Burst)}
+		m.visitors[key] = v
+	}
+	v.lastSeen = time.Now()
+	// apply reloaded limits to known clients too
+	if v.limiter.Limit() != rate.Limit(l.Rate) || v.limiter.Burst() != l.Burst {
+		v.limiter.SetLimit(rate.Limit(l.Rate))
+		v.limiter.SetBurst(l.Burst)
+	}
+
+	r := v.limiter.Reserve()
+	if delay := r.Delay(); delay > 0 {
+		r.Cancel()
+		return false, delay, nil
+	}
+	return true, 0, nil
+}
+
+// cleanup forgets every minute the clients that haven't been seen for more
+// than 3 minutes.
+func (m *Memory) cleanup() {
+	for {
+		time.Sleep(time.Minute)
+
+		m.mu.Lock()
+		for key, v := range m.visitors {
+			if time.Since(v.lastSeen) > 3*time.Minute {
+				delete(m.visitors, key)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// defaultCooldown is how long a failed Primary is skipped when Fallback has
+// no Cooldown.
+const defaultCooldown = 5 * time.Second
+
+// Fallback is a Limiter that asks Fallback when Primary fails, e.g. a
+// shared limiter whose Redis is unreachable.
+type Fallback struct {
+	Primary  Limiter
+	Fallback Limiter
+	// Cooldown is how long Primary is skipped after it failed, so requests
+	// don't all wait for it to time out. Once it is over, a single request
+	// tries Primary again. It is 5 seconds when zero.
+	Cooldown time.Duration
+
+	failing atomic.Bool
+	retryAt atomic.Int64 // unix nanoseconds
+}
+
+func (f *Fallback) cooldown() time.Duration {
+	if f.Cooldown > 0 {
+		return f.Cooldown
+	}
+	return defaultCooldown
+}
+
+// Allow asks Primary, or Fallback while Primary fails. Switching between
+// them is logged once.
+func (f *Fallback) Allow(ctx context.Context, key string, l Limit) (bool, time.Duration, error) {
+	if f.failing.Load() {
+		now := time.Now()
+		at := f.retryAt.Load()
+		if now.UnixNano() < at || !f.retryAt.CompareAndSwap(at, now.Add(f.cooldown()).UnixNano()) {
+			return f.Fallback.Allow(ctx, key, l)
+		}
+	}
+	ok, retryAfter, err := f.Primary.Allow(ctx, key, l)
+	if err == nil {
+		if f.failing.CompareAndSwap(true, false) {
+			slog.Info("Rate limiter recovered")
+		}
+		return ok, retryAfter, nil
+	}
+	f.retryAt.Store(time.Now().Add(f.cooldown()).UnixNano())
+	if f.failing.CompareAndSwap(false, true) {
+		slog.Error("Rate limiter failed, falling back", "err", err, "retryIn", f.cooldown())
+	}
+	return f.Fallback.Allow(ctx, key, l)
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// gcra implements the generic cell rate algorithm. KEYS[1] holds the
+// theoretical arrival time (TAT) of the client's next request, in
+// microseconds of the Redis clock so that every replica agrees on it.
+// ARGV[1] is the emission interval and ARGV[2] the burst. It returns 1 and 0
+// when the request is allowed, 0 and the microseconds to wait otherwise.
+var gcra = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local allowAt = tat + interval - burst * interval
+if allowAt > now then
+	return {0, allowAt - now}
+end
+tat = tat + interval
+redis.call("SET", KEYS[1], tat, "PX", math.ceil((tat - now) / 1000))
+return {1, 0}
+`)
+
+// redisTimeout bounds every Redis call, so a slow Redis fails over to the
+// fallback limiter instead of stalling requests.
+const redisTimeout = 500 * time.Millisecond
+
+// Redis is a Limiter keeping the state of every client in Redis, so that
+// replicas sharing it enforce a single limit.
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedis creates a Redis limiter keeping its keys under prefix.
+func NewRedis(client *redis.Client, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+// Allow runs the GCRA script for key.
+func (r *Redis) Allow(ctx context.Context, key string, l Limit) (bool, time.Duration, error) {
+	if l.Rate <= 0 || l.Burst <= 0 {
+		return false, 0, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	interval := int64(float64(time.Second/time.Microsecond) / l.Rate)
+	res, err := gcra.Run(ctx, r.client, []string{r.prefix + key}, interval, l.Burst).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Microsecond, nil
+}
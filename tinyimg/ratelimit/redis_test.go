@@ -0,0 +1,179 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis starts a miniredis server with a fixed clock and returns it
+// with a function creating limiters on new clients of it.
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, func() *Redis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	mr.SetTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	return mr, func() *Redis {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+		t.Cleanup(func() { client.Close() })
+		return NewRedis(client, "test:")
+	}
+}
+
+func allow(t *testing.T, l Limiter, key string, limit Limit) (bool, time.Duration) {
+	t.Helper()
+	ok, retryAfter, err := l.Allow(context.Background(), key, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok, retryAfter
+}
+
+func TestRedisSharedBurst(t *testing.T) {
+	_, newLimiter := newTestRedis(t)
+	a, b := newLimiter(), newLimiter()
+	limit := Limit{Rate: 1, Burst: 3}
+
+	// both replicas take from the same burst
+	for i, l := range []*Redis{a, b, a} {
+		if ok, _ := allow(t, l, "client", limit); !ok {
+			t.Fatalf("request %d refused within the burst", i)
+		}
+	}
+	ok, retryAfter := allow(t, b, "client", limit)
+	if ok {
+		t.Fatal("request allowed past the burst")
+	}
+	if retryAfter != time.Second {
+		t.Fatalf("retry after %v, want %v", retryAfter, time.Second)
+	}
+}
+
+func TestRedisKeys(t *testing.T) {
+	_, newLimiter := newTestRedis(t)
+	l := newLimiter()
+	limit := Limit{Rate: 1, Burst: 1}
+
+	if ok, _ := allow(t, l, "a", limit); !ok {
+		t.Fatal("first request of a refused")
+	}
+	if ok, _ := allow(t, l, "a", limit); ok {
+		t.Fatal("second request of a allowed")
+	}
+	if ok, _ := allow(t, l, "b", limit); !ok {
+		t.Fatal("b is limited by the requests of a")
+	}
+}
+
+func TestRedisRefill(t *testing.T) {
+	mr, newLimiter := newTestRedis(t)
+	l := newLimiter()
+	limit := Limit{Rate: 2, Burst: 2}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		allow(t, l, "client", limit)
+	}
+	if ok, _ := allow(t, l, "client", limit); ok {
+		t.Fatal("request allowed past the burst")
+	}
+	// one request is allowed again after each emission interval
+	mr.SetTime(start.Add(500 * time.Millisecond))
+	if ok, _ := allow(t, l, "client", limit); !ok {
+		t.Fatal("request refused after the emission interval")
+	}
+	if ok, _ := allow(t, l, "client", limit); ok {
+		t.Fatal("two requests allowed after one emission interval")
+	}
+}
+
+func TestRedisKeyExpiry(t *testing.T) {
+	mr, newLimiter := newTestRedis(t)
+	l := newLimiter()
+	limit := Limit{Rate: 1, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		allow(t, l, "client", limit)
+	}
+	// the key lives until the burst is refilled
+	if ttl := mr.TTL("test:client"); ttl != 3*time.Second {
+		t.Fatalf("ttl %v, want %v", ttl, 3*time.Second)
+	}
+	mr.FastForward(3 * time.Second)
+	if mr.Exists("test:client") {
+		t.Fatal("key did not expire")
+	}
+}
+
+func TestRedisFallback(t *testing.T) {
+	mr, newLimiter := newTestRedis(t)
+	f := &Fallback{Primary: newLimiter(), Fallback: NewMemory()}
+	limit := Limit{Rate: 1, Burst: 2}
+
+	if ok, _ := allow(t, f, "client", limit); !ok {
+		t.Fatal("request refused by Redis")
+	}
+	mr.Close()
+	// the fallback has its own buckets and still limits
+	for i := 0; i < 2; i++ {
+		if ok, _ := allow(t, f, "client", limit); !ok {
+			t.Fatalf("request %d refused by the fallback within the burst", i)
+		}
+	}
+	if ok, _ := allow(t, f, "client", limit); ok {
+		t.Fatal("request allowed past the burst of the fallback")
+	}
+	if !f.failing.Load() {
+		t.Fatal("the fallback is not marked as used")
+	}
+}
+
+// funcLimiter is a Limiter counting its calls and failing while fail is set.
+type funcLimiter struct {
+	calls atomic.Int32
+	fail  atomic.Bool
+}
+
+func (l *funcLimiter) Allow(context.Context, string, Limit) (bool, time.Duration, error) {
+	l.calls.Add(1)
+	if l.fail.Load() {
+		return false, 0, errors.New("primary is down")
+	}
+	return true, 0, nil
+}
+
+func TestFallbackCooldown(t *testing.T) {
+	primary := &funcLimiter{}
+	primary.fail.Store(true)
+	f := &Fallback{Primary: primary, Fallback: NewMemory(), Cooldown: 50 * time.Millisecond}
+	limit := Limit{Rate: 100, Burst: 100}
+
+	for i := 0; i < 10; i++ {
+		allow(t, f, "client", limit)
+	}
+	if n := primary.calls.Load(); n != 1 {
+		t.Fatalf("primary called %d times during the cooldown, want 1", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	allow(t, f, "client", limit)
+	if n := primary.calls.Load(); n != 2 {
+		t.Fatalf("primary called %d times after the cooldown, want 2", n)
+	}
+
+	primary.fail.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		allow(t, f, "client", limit)
+	}
+	if n := primary.calls.Load(); n != 5 {
+		t.Fatalf("primary called %d times after recovering, want 5", n)
+	}
+	if f.failing.Load() {
+		t.Fatal("still falling back after the primary recovered")
+	}
+}
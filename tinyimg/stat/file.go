@@ -0,0 +1,89 @@
+package stat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore persists the stats as a JSON file. It is meant for a single
+// replica.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStore creates a FileStore writing to path.
+func NewFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	return &FileStore{path: path}, nil
+}
+
+// Load reads the stats file. A missing file is empty stats.
+func (s *FileStore) Load(_ context.Context) (map[string]Counts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+// Add adds deltas to the stats file.
+func (s *FileStore) Add(_ context.Context, deltas map[string]Counts) (map[string]Counts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	for name, d := range deltas {
+		counts[name] = counts[name].add(d)
+	}
+	return counts, s.write(counts)
+}
+
+// Delete removes names from the stats file.
+func (s *FileStore) Delete(_ context.Context, names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts, err := s.read()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		delete(counts, name)
+	}
+	return s.write(counts)
+}
+
+func (s *FileStore) read() (map[string]Counts, error) {
+	counts := make(map[string]Counts)
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return counts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// write replaces the stats file through a rename, so a crash never leaves
+// it half written.
+func (s *FileStore) write(counts map[string]Counts) error {
+	data, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,77 @@
+package stat
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats", "stats.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	counts, err := store.Load(ctx)
+	if err != nil || len(counts) != 0 {
+		t.Fatalf("Load() of a missing file = %v, %v", counts, err)
+	}
+
+	if _, err = store.Add(ctx, map[string]Counts{Total: {ByteCount: 10, ImageCount: 1}, "a": {TimeCount: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	counts, err = store.Add(ctx, map[string]Counts{Total: {ByteCount: 5, ImageCount: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := counts[Total]; c.ByteCount != 15 || c.ImageCount != 2 {
+		t.Fatalf("Add() returned %+v", c)
+	}
+	// the file is replaced through a rename, no temporary file is left
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+	if err = store.Delete(ctx, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new store reads back what the first one wrote
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err = reopened.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts[Total] != (Counts{ByteCount: 15, ImageCount: 2}) {
+		t.Fatalf("Load() = %+v", counts)
+	}
+}
+
+func TestFileStoreCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	if err := os.WriteFile(path, []byte(`{"total":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Load(context.Background()); err == nil {
+		t.Fatal("loaded a corrupt file")
+	}
+	// the file is neither overwritten by Add nor ignored by NewStat
+	if _, err = store.Add(context.Background(), map[string]Counts{Total: {ImageCount: 1}}); err == nil {
+		t.Fatal("added to a corrupt file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != `{"total":` {
+		t.Fatalf("corrupt file was replaced by %s", data)
+	}
+	if _, err = NewStat(store, time.Hour); err == nil {
+		t.Fatal("created a Stat from a corrupt file")
+	}
+}
@@ -0,0 +1,82 @@
+package stat
+
+import (
+	"context"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore persists the stats as one Redis hash per name, so replicas
+// sharing it add up their counts.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStore creates a RedisStore keeping its hashes under prefix.
+func NewRedisStore(client *redis.Client, prefix string) *RedisStore {
+	return &RedisStore{client: client, prefix: prefix}
+}
+
+// Load reads every hash under the store's prefix.
+func (s *RedisStore) Load(ctx context.Context) (map[string]Counts, error) {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, s.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HGetAll(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && len(keys) > 0 {
+		return nil, err
+	}
+
+	counts := make(map[string]Counts, len(keys))
+	for i, key := range keys {
+		var c Counts
+		if err := cmds[i].Scan(&c); err != nil {
+			return nil, err
+		}
+		counts[strings.TrimPrefix(key, s.prefix)] = c
+	}
+	return counts, nil
+}
+
+// Add increments the hashes of deltas atomically.
+func (s *RedisStore) Add(ctx context.Context, deltas map[string]Counts) (map[string]Counts, error) {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for name, d := range deltas {
+			key := s.prefix + name
+			pipe.HIncrBy(ctx, key, "byteCount", d.ByteCount)
+			pipe.HIncrBy(ctx, key, "imageCount", d.ImageCount)
+			pipe.HIncrBy(ctx, key, "timeCount", d.TimeCount)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts, err := s.Load(ctx)
+	if err != nil {
+		// the increments are in, they must not be retried
+		return nil, nil
+	}
+	return counts, nil
+}
+
+// Delete removes the hashes of names.
+func (s *RedisStore) Delete(ctx context.Context, names []string) error {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = s.prefix + name
+	}
+	return s.client.Del(ctx, keys...).Err()
+}
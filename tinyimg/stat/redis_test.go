@@ -0,0 +1,77 @@
+package stat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisStore(t *testing.T, mr *miniredis.Miniredis, prefix string) *RedisStore {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisStore(client, prefix)
+}
+
+func TestRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	a, b := newTestRedisStore(t, mr, "stats:"), newTestRedisStore(t, mr, "stats:")
+	other := newTestRedisStore(t, mr, "other:")
+
+	counts, err := a.Load(ctx)
+	if err != nil || len(counts) != 0 {
+		t.Fatalf("Load() of an empty store = %v, %v", counts, err)
+	}
+	if _, err = other.Add(ctx, map[string]Counts{Total: {ImageCount: 100}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// replicas sharing a prefix add up their counts
+	if _, err = a.Add(ctx, map[string]Counts{Total: {ByteCount: 10, ImageCount: 1}, "a": {TimeCount: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	counts, err = b.Add(ctx, map[string]Counts{Total: {ByteCount: 5, ImageCount: 1, TimeCount: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Counts{
+		Total: {ByteCount: 15, ImageCount: 2, TimeCount: 3},
+		"a":   {TimeCount: 5},
+	}
+	if len(counts) != len(want) || counts[Total] != want[Total] || counts["a"] != want["a"] {
+		t.Fatalf("Add() = %+v, want %+v", counts, want)
+	}
+	if v := mr.HGet("stats:total", "byteCount"); v != "15" {
+		t.Fatalf("byteCount of stats:total = %s", v)
+	}
+
+	if err = b.Delete(ctx, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	counts, err = a.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts[Total] != want[Total] {
+		t.Fatalf("Load() = %+v", counts)
+	}
+	if c, _ := other.Load(ctx); c[Total].ImageCount != 100 {
+		t.Fatalf("counts of another prefix = %+v", c)
+	}
+}
+
+func TestRedisStoreDown(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := newTestRedisStore(t, mr, "stats:")
+	mr.Close()
+	if _, err := store.Add(context.Background(), map[string]Counts{Total: {ImageCount: 1}}); err == nil {
+		t.Fatal("added to a store that is down")
+	}
+	if _, err := NewStat(store, time.Hour); err == nil {
+		t.Fatal("created a Stat from a store that is down")
+	}
+}
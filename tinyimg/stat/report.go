@@ -0,0 +1,105 @@
+package stat
+
+import (
+	"strings"
+	"time"
+)
+
+// Summary are the counts of a set of conversions with their average time.
+type Summary struct {
+	Counts
+	// AvgTime is the average conversion time in milliseconds.
+	AvgTime float64 `json:"avgTime"`
+}
+
+func summarize(c Counts) Summary {
+	s := Summary{Counts: c}
+	if c.ImageCount > 0 {
+		s.AvgTime = float64(c.TimeCount) / float64(c.ImageCount)
+	}
+	return s
+}
+
+// Bucket is the Summary of the conversions of an hour or a day.
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Summary
+}
+
+// Report is the breakdown of the app stats.
+type Report struct {
+	Total         Summary            `json:"total"`
+	InputFormats  map[string]Summary `json:"inputFormats"`
+	OutputFormats map[string]Summary `json:"outputFormats"`
+	Encoders      map[string]Summary `json:"encoders"`
+	// Hourly covers the last 24 hours and Daily the last 30 days, oldest
+	// first, including the current hour and day.
+	Hourly []Bucket `json:"hourly"`
+	Daily  []Bucket `json:"daily"`
+}
+
+// Report returns the breakdown of the app stats at now.
+func (s *Stat) Report(now time.Time) Report {
+	r := Report{
+		Total:         summarize(s.Counts(Total)),
+		InputFormats:  make(map[string]Summary),
+		OutputFormats: make(map[string]Summary),
+		Encoders:      make(map[string]Summary),
+	}
+	for _, name := range s.names() {
+		breakdown, key, ok := strings.Cut(name, ":")
+		if !ok {
+			continue
+		}
+		switch breakdown + ":" {
+		case InputFormat:
+			r.InputFormats[key] = summarize(s.Counts(name))
+		case OutputFormat:
+			r.OutputFormats[key] = summarize(s.Counts(name))
+		case Encoder:
+			r.Encoders[key] = summarize(s.Counts(name))
+		}
+	}
+
+	now = now.UTC()
+	hour := now.Truncate(time.Hour)
+	for i := 23; i >= 0; i-- {
+		start := hour.Add(-time.Duration(i) * time.Hour)
+		r.Hourly = append(r.Hourly, Bucket{
+			Start:   start,
+			Summary: summarize(s.Counts(Hour + start.Format(hourLayout))),
+		})
+	}
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for i := 29; i >= 0; i-- {
+		start := day.AddDate(0, 0, -i)
+		r.Daily = append(r.Daily, Bucket{
+			Start:   start,
+			Summary: summarize(s.Counts(Day + start.Format(dayLayout))),
+		})
+	}
+	return r
+}
+
+// names returns the names of every counter, persisted or not.
+func (s *Stat) names() []string {
+	seen := make(map[string]bool)
+	s.mu.RLock()
+	for name := range s.persisted {
+		seen[name] = true
+	}
+	for name := range s.flushing {
+		seen[name] = true
+	}
+	s.mu.RUnlock()
+	s.pending.Range(func(name, _ any) bool {
+		seen[name.(string)] = true
+		return true
+	})
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	return names
+}
@@ -1,76 +1,304 @@
 package stat
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Stat represents application statistics.
-type Stat struct {
-	ByteCount  int64 `json:"byteCount"`
-	ImageCount int   `json:"imageCount"`
-	TimeCount  int64 `json:"timeCount"`
+// Total is the name of the counters covering every conversion. The other
+// names are a breakdown by dimension, see Record.
+const Total = "total"
 
-	Logger *slog.Logger
+// Prefixes of the counter names of a breakdown.
+const (
+	InputFormat  = "input:"
+	OutputFormat = "output:"
+	Encoder      = "encoder:"
+	Hour         = "hour:"
+	Day          = "day:"
+)
+
+// Layouts of the time buckets in counter names, in UTC.
+const (
+	hourLayout = "2006-01-02T15"
+	dayLayout  = "2006-01-02"
+)
+
+// Retention of the time buckets. Older buckets are deleted when flushing.
+const (
+	hourRetention = 7 * 24 * time.Hour
+	dayRetention  = 365 * 24 * time.Hour
+)
+
+// Options represent where the app stats are persisted.
+type Options struct {
+	// Backend is "file" (the default), "redis" or "none".
+	Backend string `json:"backend"`
+	// File is the path of the file backend.
+	File string `json:"file"`
+	// RedisPrefix is prepended to the keys of the redis backend.
+	RedisPrefix string `json:"redisPrefix"`
+	// FlushInterval is how often new counts are written to the backend.
+	FlushInterval time.Duration `json:"flushInterval"`
+}
+
+// Counts are the totals of a set of conversions.
+type Counts struct {
+	ByteCount  int64 `json:"byteCount" redis:"byteCount"`
+	ImageCount int64 `json:"imageCount" redis:"imageCount"`
+	TimeCount  int64 `json:"timeCount" redis:"timeCount"`
+}
+
+func (c Counts) add(o Counts) Counts {
+	return Counts{
+		ByteCount:  c.ByteCount + o.ByteCount,
+		ImageCount: c.ImageCount + o.ImageCount,
+		TimeCount:  c.TimeCount + o.TimeCount,
+	}
+}
+
+func (c Counts) isZero() bool {
+	return c == Counts{}
+}
+
+// Store persists named Counts.
+type Store interface {
+	// Load returns the persisted counts.
+	Load(ctx context.Context) (map[string]Counts, error)
+	// Add adds deltas to the persisted counts and returns all of them, which
+	// may include counts added by other replicas. If the deltas were added
+	// but the counts can't be read back, it returns nil and no error.
+	Add(ctx context.Context, deltas map[string]Counts) (map[string]Counts, error)
+	// Delete removes the counts with the given names.
+	Delete(ctx context.Context, names []string) error
+}
+
+// counters are the counts of a name not flushed yet.
+type counters struct {
+	bytes  atomic.Int64
+	images atomic.Int64
+	time   atomic.Int64
+}
+
+func (c *counters) swap() Counts {
+	return Counts{
+		ByteCount:  c.bytes.Swap(0),
+		ImageCount: c.images.Swap(0),
+		TimeCount:  c.time.Swap(0),
+	}
+}
+
+func (c *counters) load() Counts {
+	return Counts{
+		ByteCount:  c.bytes.Load(),
+		ImageCount: c.images.Load(),
+		TimeCount:  c.time.Load(),
+	}
 }
 
-var stat *Stat
+// Stat represents application statistics. Counts are incremented
+// atomically in memory and periodically added to the Store, so the totals
+// survive restarts and are shared by replicas using the same Store.
+type Stat struct {
+	Logger *slog.Logger
+
+	store   Store
+	pending sync.Map // name -> *counters
 
-// NewStat returns a new Stat instance.
-func NewStat() *Stat {
+	// flushMu serializes flushes; mu guards the counts moved out of
+	// pending, which are in flushing while they are added to the store
+	flushMu   sync.Mutex
+	mu        sync.RWMutex
+	flushing  map[string]Counts
+	persisted map[string]Counts
+}
+
+// NewStat returns a new Stat restored from store, which is flushed every
+// interval. A nil store keeps the stats in memory only, the expired time
+// buckets are still dropped every interval. It fails when the persisted
+// stats can't be loaded, rather than starting over from zero.
+func NewStat(store Store, interval time.Duration) (*Stat, error) {
 	logger := slog.Default()
-	logger.Info("Stat initialized...")
-	if stat == nil {
-		stat = &Stat{
-			Logger: logger,
+	s := &Stat{
+		Logger:    logger,
+		store:     store,
+		persisted: make(map[string]Counts),
+	}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		persisted, err := store.Load(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore stats: %w", err)
 		}
+		s.persisted = persisted
+	}
+	go func() {
+		for range time.Tick(max(interval, time.Second)) {
+			if err := s.Flush(context.Background()); err != nil {
+				s.Logger.Error("failed to store stats", "error", err)
+			}
+		}
+	}()
+	logger.Info("Stat initialized...")
+	return s, nil
+}
+
+// Counts returns the counts of name, including the ones not flushed yet.
+func (s *Stat) Counts(name string) Counts {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := s.persisted[name].add(s.flushing[name])
+	if p, ok := s.pending.Load(name); ok {
+		c = c.add(p.(*counters).load())
 	}
-	return stat
+	return c
 }
 
 // GetStats returns the application stats.
 func (s *Stat) GetStats() map[string]any {
+	c := s.Counts(Total)
 	return map[string]interface{}{
-		"byteCount":  s.ByteCount,
-		"imageCount": s.ImageCount,
-		"timeCount":  s.TimeCount,
+		"byteCount":  c.ByteCount,
+		"imageCount": c.ImageCount,
+		"timeCount":  c.TimeCount,
 	}
 }
 
-// IncreaseByteCount adds and persists the given byte count to the app stats.
-func (s *Stat) IncreaseByteCount(b int64) {
-	if b <= 0 {
-		return
-	}
-	s.ByteCount += b
-	if err := s.store(); err != nil {
-		s.Logger.Error("failed to store stats", "error", err)
+func (s *Stat) counters(name string) *counters {
+	if c, ok := s.pending.Load(name); ok {
+		return c.(*counters)
 	}
+	c, _ := s.pending.LoadOrStore(name, &counters{})
+	return c.(*counters)
 }
 
-// IncreaseImageCount adds and persists the given image count to the app stats.
-func (s *Stat) IncreaseImageCount(i int) {
-	if i <= 0 {
-		return
+// Record adds the counts of a conversion finished at t to the total, its
+// hourly and daily buckets and the given breakdowns, such as
+// InputFormat+"png".
+func (s *Stat) Record(c Counts, t time.Time, breakdowns ...string) {
+	if c.ByteCount < 0 {
+		c.ByteCount = 0
 	}
-	s.ImageCount += i
-	if err := s.store(); err != nil {
-		s.Logger.Error("failed to store stats", "error", err)
+	t = t.UTC()
+	names := append([]string{Total, Hour + t.Format(hourLayout), Day + t.Format(dayLayout)}, breakdowns...)
+	for _, name := range names {
+		p := s.counters(name)
+		p.bytes.Add(c.ByteCount)
+		p.images.Add(c.ImageCount)
+		p.time.Add(c.TimeCount)
 	}
 }
 
-// IncreaseTimeCount adds and persists the given time count to the app stats.
-func (s *Stat) IncreaseTimeCount(t int64) {
-	if t < 0 {
-		return
+// Flush adds the counts incremented since the last flush to the store. If
+// the store fails they are kept for the next flush. Time buckets past
+// their retention are dropped from the counts not flushed yet and deleted
+// from the store.
+func (s *Stat) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	// the deltas are moved out of pending under the lock, so readers never
+	// see them counted twice or not at all
+	now := time.Now()
+	deltas := make(map[string]Counts)
+	s.mu.Lock()
+	s.pending.Range(func(name, c any) bool {
+		if d := c.(*counters).swap(); !d.isZero() {
+			deltas[name.(string)] = d
+		}
+		if expired(name.(string), now) {
+			s.pending.Delete(name)
+		}
+		return true
+	})
+	if s.store == nil {
+		for name, d := range deltas {
+			s.persisted[name] = s.persisted[name].add(d)
+		}
+		for name := range s.persisted {
+			if expired(name, now) {
+				delete(s.persisted, name)
+			}
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	s.flushing = deltas
+	s.mu.Unlock()
+	if len(deltas) == 0 {
+		return s.deleteExpired(ctx, now)
+	}
+
+	persisted, err := s.store.Add(ctx, deltas)
+	s.mu.Lock()
+	s.flushing = nil
+	if err != nil {
+		for name, d := range deltas {
+			c := s.counters(name)
+			c.bytes.Add(d.ByteCount)
+			c.images.Add(d.ImageCount)
+			c.time.Add(d.TimeCount)
+		}
+		s.mu.Unlock()
+		return err
 	}
-	s.TimeCount += t
-	if err := s.store(); err != nil {
-		s.Logger.Error("failed to store stats", "error", err)
+	if persisted == nil {
+		persisted = s.persisted
+		for name, d := range deltas {
+			persisted[name] = persisted[name].add(d)
+		}
 	}
+	s.persisted = persisted
+	s.mu.Unlock()
+	return s.deleteExpired(ctx, now)
 }
 
-// store stores the app stats to the file system.
-func (s *Stat) store() error {
-	s.GetStats()
+// deleteExpired deletes the time buckets past their retention from the
+// store.
+func (s *Stat) deleteExpired(ctx context.Context, now time.Time) error {
+	var old []string
+	s.mu.RLock()
+	for name := range s.persisted {
+		if expired(name, now) {
+			old = append(old, name)
+		}
+	}
+	s.mu.RUnlock()
+	if len(old) == 0 {
+		return nil
+	}
+	if err := s.store.Delete(ctx, old); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, name := range old {
+		delete(s.persisted, name)
+	}
+	s.mu.Unlock()
 	return nil
 }
+
+// expired reports whether name is a time bucket past its retention.
+func expired(name string, now time.Time) bool {
+	var (
+		layout    string
+		retention time.Duration
+	)
+	switch {
+	case strings.HasPrefix(name, Hour):
+		layout, retention = hourLayout, hourRetention
+	case strings.HasPrefix(name, Day):
+		layout, retention = dayLayout, dayRetention
+	default:
+		return false
+	}
+	_, bucket, _ := strings.Cut(name, ":")
+	t, err := time.Parse(layout, bucket)
+	return err == nil && now.Sub(t) > retention
+}
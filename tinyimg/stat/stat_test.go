@@ -0,0 +1,158 @@
+package stat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is a Store keeping the counts in memory. When block is set, Add
+// sends on started and waits for block to be closed. It fails while fail
+// is set.
+type memStore struct {
+	mu      sync.Mutex
+	counts  map[string]Counts
+	started chan struct{}
+	block   chan struct{}
+	fail    bool
+}
+
+func (m *memStore) Load(context.Context) (map[string]Counts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail {
+		return nil, errors.New("store is down")
+	}
+	return map[string]Counts{}, nil
+}
+
+func (m *memStore) Add(_ context.Context, deltas map[string]Counts) (map[string]Counts, error) {
+	if m.block != nil {
+		m.started <- struct{}{}
+		<-m.block
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail {
+		return nil, errors.New("store is down")
+	}
+	all := make(map[string]Counts)
+	for name, d := range deltas {
+		m.counts[name] = m.counts[name].add(d)
+	}
+	for name, c := range m.counts {
+		all[name] = c
+	}
+	return all, nil
+}
+
+func (m *memStore) Delete(_ context.Context, names []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		delete(m.counts, name)
+	}
+	return nil
+}
+
+func newTestStat(t *testing.T, store Store) *Stat {
+	t.Helper()
+	// the interval is long enough for the tests to flush by hand
+	s, err := NewStat(store, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFlushDoesNotBlockReaders(t *testing.T) {
+	store := &memStore{counts: map[string]Counts{}, started: make(chan struct{}), block: make(chan struct{})}
+	s := newTestStat(t, store)
+	s.Record(Counts{ByteCount: 10, ImageCount: 1}, time.Now())
+
+	done := make(chan error)
+	go func() { done <- s.Flush(context.Background()) }()
+	<-store.started
+
+	// the flush is waiting for the store, the counts are still readable
+	// and counted once
+	for i := 0; i < 3; i++ {
+		if c := s.Counts(Total); c.ByteCount != 10 || c.ImageCount != 1 {
+			t.Fatalf("counts during flush = %+v", c)
+		}
+		s.Report(time.Now())
+	}
+	s.Record(Counts{ByteCount: 5, ImageCount: 1}, time.Now())
+	close(store.block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if c := s.Counts(Total); c.ByteCount != 15 || c.ImageCount != 2 {
+		t.Fatalf("counts after flush = %+v", c)
+	}
+	if c := store.counts[Total]; c.ByteCount != 10 {
+		t.Fatalf("stored counts = %+v", c)
+	}
+}
+
+func TestFlushKeepsDeltasOnError(t *testing.T) {
+	store := &memStore{counts: map[string]Counts{}}
+	s := newTestStat(t, store)
+	store.fail = true
+	s.Record(Counts{ByteCount: 10, ImageCount: 1}, time.Now())
+
+	if err := s.Flush(context.Background()); err == nil {
+		t.Fatal("flush succeeded while the store is down")
+	}
+	if c := s.Counts(Total); c.ByteCount != 10 {
+		t.Fatalf("counts after a failed flush = %+v", c)
+	}
+	store.fail = false
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c := store.counts[Total]; c.ByteCount != 10 || c.ImageCount != 1 {
+		t.Fatalf("stored counts = %+v", c)
+	}
+}
+
+func TestFlushPrunesExpiredBuckets(t *testing.T) {
+	for _, store := range []*memStore{{counts: map[string]Counts{}}, nil} {
+		var s *Stat
+		if store == nil {
+			s = newTestStat(t, nil)
+		} else {
+			s = newTestStat(t, store)
+		}
+		old := time.Now().Add(-2 * hourRetention)
+		s.Record(Counts{ByteCount: 10, ImageCount: 1}, old)
+		hour := Hour + old.UTC().Format(hourLayout)
+
+		if err := s.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.pending.Load(hour); ok {
+			t.Errorf("expired bucket %s is still pending", hour)
+		}
+		if c := s.Counts(hour); !c.isZero() {
+			t.Errorf("expired bucket %s = %+v", hour, c)
+		}
+		// the day bucket is kept
+		if c := s.Counts(Day + old.UTC().Format(dayLayout)); c.ByteCount != 10 {
+			t.Errorf("day bucket = %+v", c)
+		}
+		if store != nil {
+			if _, ok := store.counts[hour]; ok {
+				t.Errorf("expired bucket %s is still stored", hour)
+			}
+		}
+	}
+}
+
+func TestNewStatLoadError(t *testing.T) {
+	if _, err := NewStat(&memStore{fail: true}, time.Hour); err == nil {
+		t.Fatal("created a Stat without its persisted counts")
+	}
+}
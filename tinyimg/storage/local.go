@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/dunkbing/tinyimg/tinyimg/janitor"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrPresignUnsupported is returned by backends that can't sign URLs.
+var ErrPresignUnsupported = errors.New("presigned urls are not supported")
+
+// Local stores objects as files under a root directory.
+type Local struct {
+	root string
+}
+
+// NewLocal creates a Local storage rooted at dir.
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &Local{root: filepath.Clean(dir)}, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes r to the file of key, replacing it atomically.
+func (l *Local) Put(_ context.Context, key string, r io.Reader, _ int64, _ string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".put-*")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// MoveFile renames a local file into the storage, copying it when it is on
+// another file system. Files already at the key's path, as written by the
+// encoders to the output directory, are left alone.
+func (l *Local) MoveFile(ctx context.Context, key, src, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if filepath.Clean(src) == p {
+		return nil
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+	if err = os.Rename(src, p); err == nil {
+		return nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = l.Put(ctx, key, f, -1, contentType); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Get opens the file of key and marks it as accessed for the janitor.
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	janitor.Touch(p)
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := l.Stat(ctx, key)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// Stat returns the info of key's file.
+func (l *Local) Stat(_ context.Context, key string) (*ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && fi.IsDir()) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime(), ContentType: ContentType(key)}, nil
+}
+
+// Delete removes key's file. Deleting a missing object is not an error.
+func (l *Local) Delete(_ context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns the objects whose key starts with prefix.
+func (l *Local) List(_ context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime(), ContentType: ContentType(key)})
+		return nil
+	})
+	return objects, err
+}
+
+// Presign is not supported by local storage; objects are served by the
+// application itself.
+func (l *Local) Presign(_ context.Context, _ string, _ time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
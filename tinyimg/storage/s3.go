@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 stores objects in a bucket of an S3 compatible service, so every
+// replica sees the same outputs.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 creates an S3 storage from the endpoint, bucket and credentials in
+// the options.
+func NewS3(o *Options) (*S3, error) {
+	if o.Endpoint == "" || o.Bucket == "" {
+		return nil, errors.New("s3 storage needs an endpoint and a bucket")
+	}
+	client, err := minio.New(o.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(o.AccessKey, o.SecretKey, ""),
+		Secure: o.UseSSL,
+		Region: o.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3{client: client, bucket: o.Bucket, prefix: strings.Trim(o.Prefix, "/")}, nil
+}
+
+func (s *S3) object(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.prefix, key), nil
+}
+
+func (s *S3) key(object string) string {
+	if s.prefix == "" {
+		return object
+	}
+	return strings.TrimPrefix(object, s.prefix+"/")
+}
+
+// Put uploads r as key.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	object, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, object, r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+// MoveFile uploads a local file as key and removes it.
+func (s *S3) MoveFile(ctx context.Context, key, src, contentType string) error {
+	object, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.FPutObject(ctx, s.bucket, object, src, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Get downloads key.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	object, err := s.object(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, object, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, convertErr(err)
+	}
+	// GetObject is lazy, Stat makes the request and reports missing keys
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, nil, convertErr(err)
+	}
+	return obj, s.info(stat), nil
+}
+
+// Stat returns the info of key.
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	object, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := s.client.StatObject(ctx, s.bucket, object, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, convertErr(err)
+	}
+	return s.info(stat), nil
+}
+
+// Delete removes key. Deleting a missing object is not an error.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	object, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, object, minio.RemoveObjectOptions{})
+}
+
+// List returns the objects whose key starts with prefix.
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	listPrefix := prefix
+	if s.prefix != "" {
+		listPrefix = s.prefix + "/" + prefix
+	}
+	var objects []ObjectInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: listPrefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, *s.info(obj))
+	}
+	return objects, nil
+}
+
+// Presign returns a signed download URL of key.
+func (s *S3) Presign(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	object, err := s.object(key)
+	if err != nil {
+		return "", err
+	}
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, object, expiry, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *S3) info(obj minio.ObjectInfo) *ObjectInfo {
+	contentType := obj.ContentType
+	if contentType == "" {
+		contentType = ContentType(obj.Key)
+	}
+	return &ObjectInfo{Key: s.key(obj.Key), Size: obj.Size, ModTime: obj.LastModified, ContentType: contentType}
+}
+
+func convertErr(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
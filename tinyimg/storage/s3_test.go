@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a bucket of an S3 compatible service, as served by MinIO, with
+// just the requests S3 storage makes.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name        `xml:"ListBucketResult"`
+	Name        string          `xml:"Name"`
+	Prefix      string          `xml:"Prefix"`
+	KeyCount    int             `xml:"KeyCount"`
+	MaxKeys     int             `xml:"MaxKeys"`
+	IsTruncated bool            `xml:"IsTruncated"`
+	Contents    []listedContent `xml:"Contents"`
+}
+
+type listedContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket", bucket, "")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPut:
+		data, err := readPayload(r)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "IncompleteBody", bucket, key)
+			return
+		}
+		f.objects[key] = fakeObject{data: data, contentType: r.Header.Get("Content-Type"), modTime: time.Now().UTC()}
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey", bucket, key)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("ETag", etag(obj.data))
+		w.Header().Set("Last-Modified", obj.modTime.Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented", bucket, key)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	res := listBucketResult{Name: f.bucket, Prefix: prefix, MaxKeys: 1000}
+	for key, obj := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			res.Contents = append(res.Contents, listedContent{
+				Key:          key,
+				LastModified: obj.modTime.Format("2006-01-02T15:04:05.000Z"),
+				ETag:         etag(obj.data),
+				Size:         len(obj.data),
+			})
+		}
+	}
+	sort.Slice(res.Contents, func(a, b int) bool { return res.Contents[a].Key < res.Contents[b].Key })
+	res.KeyCount = len(res.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code, bucket, key string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message><BucketName>%s</BucketName><Key>%s</Key></Error>",
+		code, code, bucket, key)
+}
+
+// readPayload reads the body of a PUT, which the client sends in signed
+// chunks over plain HTTP.
+func readPayload(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var data bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data.Bytes(), nil
+		}
+		if _, err = io.CopyN(&data, br, size); err != nil {
+			return nil, err
+		}
+		if _, err = br.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, len(data))
+}
+
+// newTestS3 returns an S3 storage backed by a fakeS3.
+func newTestS3(t *testing.T, prefix string) (*S3, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{bucket: "tinyimg", objects: map[string]fakeObject{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	s, err := NewS3(&Options{
+		Endpoint:  u.Host,
+		Region:    "us-east-1",
+		Bucket:    "tinyimg",
+		Prefix:    prefix,
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+func TestS3(t *testing.T) {
+	s, _ := newTestS3(t, "")
+	testStorage(t, s)
+}
+
+func TestS3Prefix(t *testing.T) {
+	s, fake := newTestS3(t, "/outputs/")
+	testStorage(t, s)
+
+	// keys are stored under the prefix but listed without it
+	for key := range fake.objects {
+		if !strings.HasPrefix(key, "outputs/") {
+			t.Errorf("object %s is outside the prefix", key)
+		}
+	}
+}
+
+func TestS3Presign(t *testing.T) {
+	s, _ := newTestS3(t, "outputs")
+	u, err := s.Presign(context.Background(), "b.png", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Path != "/tinyimg/outputs/b.png" || parsed.Query().Get("X-Amz-Expires") != "60" {
+		t.Fatalf("presigned url %s", u)
+	}
+	if _, err = s.Presign(context.Background(), "../b.png", time.Minute); err != ErrInvalidKey {
+		t.Fatalf("presign invalid key = %v, want %v", err, ErrInvalidKey)
+	}
+}
+
+func TestNewS3NeedsBucket(t *testing.T) {
+	if _, err := NewS3(&Options{Endpoint: "localhost:9000"}); err == nil {
+		t.Fatal("created an s3 storage without a bucket")
+	}
+}
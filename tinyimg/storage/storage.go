@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dunkbing/tinyimg/tinyimg/janitor"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("object not found")
+	ErrInvalidKey = errors.New("invalid object key")
+)
+
+// Options select and configure the storage backend.
+type Options struct {
+	// Backend is either "local" or "s3".
+	Backend string `json:"backend"`
+	// Dir is the root directory of the local backend.
+	Dir string `json:"dir"`
+
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"-"`
+	SecretKey string `json:"-"`
+	UseSSL    bool   `json:"useSSL"`
+	// PresignExpiry is how long the presigned URLs clients are redirected
+	// to stay valid. When zero, or with the local backend, the application
+	// serves the images itself. The endpoint must be reachable by clients.
+	PresignExpiry time.Duration `json:"presignExpiry"`
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+	ContentType string    `json:"contentType"`
+}
+
+// Storage stores converted images under flat keys such as "<hash>.webp".
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Presign returns a URL the object can be downloaded from until expiry.
+	Presign(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// fileMover is implemented by backends that can take a local file without
+// copying it through a reader.
+type fileMover interface {
+	MoveFile(ctx context.Context, key, path, contentType string) error
+}
+
+// New returns the backend selected by the options.
+func New(o *Options) (Storage, error) {
+	switch o.Backend {
+	case "", "local":
+		return NewLocal(o.Dir)
+	case "s3":
+		return NewS3(o)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", o.Backend)
+	}
+}
+
+// MoveFile stores the local file at path under key. The local file is
+// consumed: it may be renamed or removed.
+func MoveFile(ctx context.Context, s Storage, key, path string) error {
+	contentType := ContentType(key)
+	if m, ok := s.(fileMover); ok {
+		return m.MoveFile(ctx, key, path, contentType)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err = s.Put(ctx, key, f, info.Size(), contentType); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// ContentType returns the content type of a key based on its extension.
+func ContentType(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// JanitorStore returns s as a store the janitor can sweep. Only local
+// storage refreshes the access time of the objects it serves; the objects of
+// other backends are evicted by the time they were stored.
+func JanitorStore(s Storage) janitor.Store {
+	return janitorStore{s}
+}
+
+type janitorStore struct {
+	s Storage
+}
+
+func (j janitorStore) List(ctx context.Context) ([]janitor.Object, error) {
+	objects, err := j.s.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	res := make([]janitor.Object, len(objects))
+	for i, o := range objects {
+		res[i] = janitor.Object{Key: o.Key, Size: o.Size, LastAccess: o.ModTime}
+	}
+	return res, nil
+}
+
+func (j janitorStore) Delete(ctx context.Context, key string) error {
+	return j.s.Delete(ctx, key)
+}
+
+// cleanKey rejects keys that could escape the storage root.
+func cleanKey(key string) (string, error) {
+	key = strings.TrimPrefix(filepath.ToSlash(key), "/")
+	if key == "" || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return "", ErrInvalidKey
+	}
+	return key, nil
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testStorage runs the behaviour every backend must have against s.
+func testStorage(t *testing.T, s Storage) {
+	ctx := context.Background()
+	put := func(key, content string) {
+		t.Helper()
+		if err := s.Put(ctx, key, strings.NewReader(content), int64(len(content)), ContentType(key)); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	put("a.webp", "first")
+	put("a.webp", "second")
+	put("b.png", "other")
+
+	rc, info, err := s.Get(ctx, "a.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(got) != "second" {
+		t.Fatalf("get a.webp = %q, %v", got, err)
+	}
+	if info.Key != "a.webp" || info.Size != int64(len("second")) || info.ContentType != "image/webp" {
+		t.Fatalf("get a.webp info = %+v", info)
+	}
+
+	info, err = s.Stat(ctx, "b.png")
+	if err != nil || info.Key != "b.png" || info.Size != int64(len("other")) {
+		t.Fatalf("stat b.png = %+v, %v", info, err)
+	}
+	if _, err = s.Stat(ctx, "missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stat missing = %v, want %v", err, ErrNotFound)
+	}
+	if _, _, err = s.Get(ctx, "missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get missing = %v, want %v", err, ErrNotFound)
+	}
+	for _, key := range []string{"", "../escape.png", "a/../../escape.png"} {
+		if err = s.Put(ctx, key, strings.NewReader("x"), 1, ""); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("put %q = %v, want %v", key, err, ErrInvalidKey)
+		}
+	}
+
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := objectKeys(objects); strings.Join(keys, ",") != "a.webp,b.png" {
+		t.Fatalf("list = %v", keys)
+	}
+	objects, err = s.List(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := objectKeys(objects); strings.Join(keys, ",") != "b.png" {
+		t.Fatalf("list b = %v", keys)
+	}
+
+	src := filepath.Join(t.TempDir(), "output.webp")
+	if err = os.WriteFile(src, []byte("moved"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = MoveFile(ctx, s, "c.webp", src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("moved file still exists: %v", err)
+	}
+	rc, _, err = s.Get(ctx, "c.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, []byte("moved")) {
+		t.Fatalf("get c.webp = %q", got)
+	}
+
+	if err = s.Delete(ctx, "a.webp"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Delete(ctx, "a.webp"); err != nil {
+		t.Fatalf("deleting a missing object: %v", err)
+	}
+	if _, err = s.Stat(ctx, "a.webp"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stat deleted = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func objectKeys(objects []ObjectInfo) []string {
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = o.Key
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestLocal(t *testing.T) {
+	s, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+
+	if _, err = s.Presign(context.Background(), "b.png", 0); !errors.Is(err, ErrPresignUnsupported) {
+		t.Fatalf("presign = %v, want %v", err, ErrPresignUnsupported)
+	}
+}
+
+func TestLocalMoveFileInPlace(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the encoders write their output straight into the storage directory
+	src := filepath.Join(dir, "d.png")
+	if err = os.WriteFile(src, []byte("encoded"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = MoveFile(context.Background(), s, "d.png", src); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := s.Stat(context.Background(), "d.png"); err != nil || info.Size != int64(len("encoded")) {
+		t.Fatalf("stat d.png = %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dunkbing/tinyimg/tinyimg/metrics"
+	"github.com/dunkbing/tinyimg/tinyimg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// toolPaths maps tool names to the paths they are run from.
+var toolPaths atomic.Pointer[map[string]string]
+
+// SetToolPaths sets the paths external tools are run from, keyed by tool
+// name. Tools without a path are looked up in PATH.
+func SetToolPaths(paths map[string]string) {
+	toolPaths.Store(&paths)
+}
+
+// ToolPath returns the path the tool name is run from.
+func ToolPath(name string) string {
+	if paths := toolPaths.Load(); paths != nil {
+		if path, ok := (*paths)[name]; ok {
+			return path
+		}
+	}
+	return name
+}
+
+// waitDelay is how long a killed command may take to release its output
+// before RunCommand gives up on it.
+const waitDelay = 5 * time.Second
+
+// RunCommand runs an external tool and waits for it to finish. The process is
+// killed when ctx is done, in which case the context's error is returned.
+// The tool is run from its path set by SetToolPaths.
+func RunCommand(ctx context.Context, name string, args ...string) (err error) {
+	ctx, span := tracing.Start(ctx, "exec "+name,
+		attribute.StringSlice("process.command_args", append([]string{name}, args...)),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ToolPath(name), args...)
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = waitDelay
+
+	err = cmd.Run()
+	if cmd.ProcessState != nil {
+		span.SetAttributes(attribute.Int("process.exit.code", cmd.ProcessState.ExitCode()))
+	}
+	if ctx.Err() != nil {
+		exitCode := "canceled"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			exitCode = "timeout"
+		}
+		metrics.ToolFailures.WithLabelValues(name, exitCode).Inc()
+		return fmt.Errorf("%s: %w", name, ctx.Err())
+	}
+	if err != nil {
+		exitCode := "start"
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = strconv.Itoa(exitErr.ExitCode())
+		}
+		metrics.ToolFailures.WithLabelValues(name, exitCode).Inc()
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
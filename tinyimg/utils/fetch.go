@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrInvalidUrl       = errors.New("invalid url")
+	ErrBlockedAddress   = errors.New("address is not allowed")
+	ErrTooManyRedirects = errors.New("too many redirects")
+	ErrTooLarge         = errors.New("remote file is too large")
+)
+
+// blockedNets are address ranges that are not covered by the net.IP helpers
+// but must not be reachable from user supplied URLs.
+var blockedNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),          // "this" network
+	mustParseCIDR("240.0.0.0/4"),        // reserved
+	mustParseCIDR("255.255.255.255/32"), // limited broadcast
+	mustParseCIDR("100.64.0.0/10"),      // carrier-grade NAT
+	mustParseCIDR("192.0.0.0/24"),       // IETF protocol assignments
+	mustParseCIDR("198.18.0.0/15"),      // benchmarking
+	mustParseCIDR("64:ff9b::/96"),       // NAT64
+}
+
+// Fetcher downloads remote files on behalf of clients. It refuses to connect
+// to private, loopback and link-local addresses, checked on every connection
+// so redirects and DNS rebinding can't reach them either.
+type Fetcher struct {
+	MaxRedirects int
+	Timeout      time.Duration
+	// AllowPrivate disables the address checks, e.g. to fetch from a local
+	// test server.
+	AllowPrivate bool
+
+	once   sync.Once
+	client *http.Client
+}
+
+// Fetch opens the file at url_, refusing files announced as larger than
+// maxBytes when it is positive. The caller must close the returned body and
+// should still limit how much of it is read, as servers may omit or lie
+// about the Content-Length.
+func (f *Fetcher) Fetch(ctx context.Context, url_ string, maxBytes int64) (io.ReadCloser, error) {
+	u, err := url.Parse(url_)
+	if !IsValidUrl(url_) || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidUrl
+	}
+	cancel := context.CancelFunc(func() {})
+	if f.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res, err := f.httpClient().Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if maxBytes > 0 && res.ContentLength > maxBytes {
+		res.Body.Close()
+		cancel()
+		return nil, ErrTooLarge
+	}
+	return &body{ReadCloser: res.Body, cancel: cancel}, nil
+}
+
+// body releases the request's timeout when the response body is closed.
+type body struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *body) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func (f *Fetcher) httpClient() *http.Client {
+	f.once.Do(f.init)
+	return f.client
+}
+
+func (f *Fetcher) init() {
+	f.client = &http.Client{
+		Transport: NewTransport(f.AllowPrivate),
+		CheckRedirect: func(_ *http.Request, via []*http.Request) error {
+			if len(via) > f.MaxRedirects {
+				return ErrTooManyRedirects
+			}
+			return nil
+		},
+	}
+}
+
+// NewTransport returns a transport that refuses to connect to the addresses
+// blocked by IsBlockedIP, unless allowPrivate is set. The address is checked
+// when connecting, after DNS resolution, so redirects and DNS rebinding
+// can't get around it.
+func NewTransport(allowPrivate bool) *http.Transport {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || IsBlockedIP(ip) {
+				return ErrBlockedAddress
+			}
+			return nil
+		}
+	}
+	return &http.Transport{
+		// a proxy would make the connection checks useless
+		Proxy:               nil,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// CheckHost resolves host and returns ErrBlockedAddress if any of its
+// addresses is blocked by IsBlockedIP. It lets URLs be rejected when they are
+// submitted rather than when they are first used.
+func CheckHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		if IsBlockedIP(ip) {
+			return ErrBlockedAddress
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if IsBlockedIP(addr.IP) {
+			return ErrBlockedAddress
+		}
+	}
+	return nil
+}
+
+// IsBlockedIP reports whether ip is a loopback, private, link-local or other
+// non-public address.
+func IsBlockedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchAllowPrivate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "image")
+	}))
+	defer srv.Close()
+
+	f := &Fetcher{AllowPrivate: true}
+	body, err := f.Fetch(context.Background(), srv.URL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	if err != nil || string(got) != "image" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestFetchBlocksLoopback(t *testing.T) {
+	var called atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called.Store(true)
+	}))
+	defer srv.Close()
+
+	f := &Fetcher{}
+	_, err := f.Fetch(context.Background(), srv.URL, 0)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("got %v, want %v", err, ErrBlockedAddress)
+	}
+	if called.Load() {
+		t.Fatal("the loopback server was reached")
+	}
+}
+
+func TestFetchSizeLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(100))
+		w.Write(make([]byte, 100))
+	}))
+	defer srv.Close()
+
+	f := &Fetcher{AllowPrivate: true}
+	if _, err := f.Fetch(context.Background(), srv.URL, 99); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want %v", err, ErrTooLarge)
+	}
+	body, err := f.Fetch(context.Background(), srv.URL, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+}
+
+func TestFetchRedirectLimit(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		if n > 0 {
+			http.Redirect(w, r, srv.URL+"/?n="+strconv.Itoa(n-1), http.StatusFound)
+			return
+		}
+		io.WriteString(w, "image")
+	}))
+	defer srv.Close()
+
+	f := &Fetcher{MaxRedirects: 2, AllowPrivate: true}
+	body, err := f.Fetch(context.Background(), srv.URL+"/?n=2", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if _, err = f.Fetch(context.Background(), srv.URL+"/?n=3", 0); !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("got %v, want %v", err, ErrTooManyRedirects)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	f := &Fetcher{Timeout: 50 * time.Millisecond, AllowPrivate: true}
+	start := time.Now()
+	if _, err := f.Fetch(context.Background(), srv.URL, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("took %s", took)
+	}
+}
+
+func TestIsBlockedIP(t *testing.T) {
+	for addr, blocked := range map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"169.254.169.254": true,
+		"0.0.0.0":         true,
+		"0.1.2.3":         true,
+		"240.0.0.1":       true,
+		"255.255.255.255": true,
+		"100.64.0.1":      true,
+		"::1":             true,
+		"fe80::1":         true,
+		"1.1.1.1":         false,
+		"2606:4700::1111": false,
+	} {
+		if got := IsBlockedIP(net.ParseIP(addr)); got != blocked {
+			t.Errorf("IsBlockedIP(%s) = %t, want %t", addr, got, blocked)
+		}
+	}
+}
@@ -122,7 +122,7 @@ func DownloadVideo(url, outDir string) (string, error) {
 	if strings.Contains(url, "tiktok") {
 		args = append([]string{"-f", "0"}, args...)
 	}
-	cmd := exec.Command("yt-dlp", args...)
+	cmd := exec.Command(ToolPath("yt-dlp"), args...)
 	err := cmd.Run()
 	if err != nil {
 		return "", fmt.Errorf("error executing yt-dlp: %w", err)
@@ -160,7 +160,7 @@ func DownloadPlaylist(url, outDir string) (string, error) {
 	id := uuid.New().String()
 	outDest := filepath.Join(outDir, id)
 	output := outDest + "/%(playlist_index)s - %(title)s.%(ext)s"
-	cmd := exec.Command("yt-dlp", "-o", output, "--quiet", url)
+	cmd := exec.Command(ToolPath("yt-dlp"), "-o", output, "--quiet", url)
 	err := cmd.Run()
 	if err != nil {
 		return "", fmt.Errorf("error executing yt-dlp: %w", err)
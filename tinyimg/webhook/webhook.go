@@ -0,0 +1,239 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dunkbing/tinyimg/tinyimg/utils"
+	"github.com/google/uuid"
+)
+
+const (
+	// SignatureHeader holds the hex encoded HMAC-SHA256 of the request body,
+	// prefixed with "sha256=".
+	SignatureHeader = "X-Tinyimg-Signature"
+	// DeliveryHeader holds the ID of the delivery, which stays the same
+	// across retries.
+	DeliveryHeader = "X-Tinyimg-Delivery"
+)
+
+// Options represent webhook delivery options.
+type Options struct {
+	MaxAttempts int           `json:"maxAttempts"`
+	BaseDelay   time.Duration `json:"baseDelay"`
+	MaxDelay    time.Duration `json:"maxDelay"`
+	Timeout     time.Duration `json:"timeout"`
+	// AllowPrivate lets callbacks reach loopback, private and link-local
+	// addresses, e.g. a receiver on the same host. Leave it off when
+	// untrusted clients can pass callback URLs.
+	AllowPrivate bool `json:"allowPrivate"`
+}
+
+// Delivery is a pending webhook call. It is persisted to disk until it
+// succeeds or runs out of attempts, so retries survive restarts.
+type Delivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+}
+
+// Dispatcher signs and delivers webhook calls, retrying failed ones with
+// exponential backoff.
+type Dispatcher struct {
+	dir    string
+	secret []byte
+	opts   Options
+	client *http.Client
+	logger *slog.Logger
+}
+
+// NewDispatcher creates a Dispatcher that persists pending deliveries in dir
+// and resumes the ones left over from a previous run.
+func NewDispatcher(dir, secret string, o *Options) (*Dispatcher, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	d := &Dispatcher{
+		dir:    dir,
+		secret: []byte(secret),
+		opts:   *o,
+		client: &http.Client{
+			Timeout:   o.Timeout,
+			Transport: utils.NewTransport(o.AllowPrivate),
+		},
+		logger: slog.Default(),
+	}
+	if err := d.resume(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Enabled reports whether a signing secret is configured.
+func (d *Dispatcher) Enabled() bool {
+	return len(d.secret) > 0
+}
+
+// CheckURL returns an error if url can't be used as a callback URL: it must
+// be an absolute http or https URL and, unless AllowPrivate is set, its host
+// must not resolve to a blocked address. The address is checked again on
+// every delivery.
+func (d *Dispatcher) CheckURL(ctx context.Context, url_ string) error {
+	u, err := url.Parse(url_)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return utils.ErrInvalidUrl
+	}
+	if d.opts.AllowPrivate {
+		return nil
+	}
+	return utils.CheckHost(ctx, u.Hostname())
+}
+
+// Enqueue persists a delivery of payload to url and starts delivering it.
+func (d *Dispatcher) Enqueue(url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	delivery := &Delivery{
+		ID:          uuid.New().String(),
+		URL:         url,
+		Payload:     body,
+		NextAttempt: time.Now(),
+	}
+	if err = d.save(delivery); err != nil {
+		return err
+	}
+	go d.deliver(delivery)
+	return nil
+}
+
+// Sign returns the signature of body sent in SignatureHeader.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver sends a delivery until it succeeds or runs out of attempts.
+func (d *Dispatcher) deliver(delivery *Delivery) {
+	for {
+		time.Sleep(time.Until(delivery.NextAttempt))
+
+		err := d.send(delivery)
+		delivery.Attempts++
+		if err == nil {
+			d.logger.Info("webhook delivered", "id", delivery.ID, "url", delivery.URL, "attempts", delivery.Attempts)
+			d.remove(delivery)
+			return
+		}
+		if delivery.Attempts >= d.opts.MaxAttempts {
+			d.logger.Error("webhook failed, giving up", "id", delivery.ID, "url", delivery.URL, "err", err)
+			d.remove(delivery)
+			return
+		}
+
+		delivery.NextAttempt = time.Now().Add(d.backoff(delivery.Attempts))
+		d.logger.Warn("webhook failed, retrying", "id", delivery.ID, "url", delivery.URL, "err", err, "next", delivery.NextAttempt)
+		if err = d.save(delivery); err != nil {
+			d.logger.Error("failed to persist webhook", "id", delivery.ID, "err", err)
+		}
+	}
+}
+
+func (d *Dispatcher) send(delivery *Delivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(d.secret, delivery.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// drain the body so the connection can be reused
+	defer res.Body.Close()
+	defer io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt, doubling from BaseDelay
+// up to MaxDelay.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.opts.BaseDelay
+	for i := 1; i < attempts && delay < d.opts.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, d.opts.MaxDelay)
+}
+
+// resume restarts the deliveries persisted by a previous run.
+func (d *Dispatcher) resume() error {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(d.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		delivery := &Delivery{}
+		if err = json.Unmarshal(data, delivery); err != nil {
+			d.logger.Error("invalid webhook delivery", "file", entry.Name(), "err", err)
+			continue
+		}
+		d.logger.Info("resuming webhook", "id", delivery.ID, "url", delivery.URL)
+		go d.deliver(delivery)
+	}
+	return nil
+}
+
+// save writes a delivery to disk, replacing the previous version atomically.
+func (d *Dispatcher) save(delivery *Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	tmp := d.path(delivery) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path(delivery))
+}
+
+func (d *Dispatcher) remove(delivery *Delivery) {
+	if err := os.Remove(d.path(delivery)); err != nil && !os.IsNotExist(err) {
+		d.logger.Error("failed to remove webhook", "id", delivery.ID, "err", err)
+	}
+}
+
+func (d *Dispatcher) path(delivery *Delivery) string {
+	return filepath.Join(d.dir, delivery.ID+".json")
+}
@@ -0,0 +1,226 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// call is a request received by a test receiver.
+type call struct {
+	delivery  string
+	signature string
+	body      []byte
+	at        time.Time
+}
+
+// receiver is a webhook receiver answering the statuses in order, then 200.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	calls    []call
+	received chan struct{}
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, string) {
+	t.Helper()
+	r := &receiver{statuses: statuses, received: make(chan struct{}, 16)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.calls = append(r.calls, call{
+			delivery:  req.Header.Get(DeliveryHeader),
+			signature: req.Header.Get(SignatureHeader),
+			body:      body,
+			at:        time.Now(),
+		})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+		w.WriteHeader(status)
+		r.received <- struct{}{}
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv.URL
+}
+
+// wait waits for n more calls and returns every call received so far.
+func (r *receiver) wait(t *testing.T, n int) []call {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d calls", i, n)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]call(nil), r.calls...)
+}
+
+func newTestDispatcher(t *testing.T, dir string) *Dispatcher {
+	t.Helper()
+	d, err := NewDispatcher(dir, "secret", &Options{
+		MaxAttempts:  4,
+		BaseDelay:    20 * time.Millisecond,
+		MaxDelay:     time.Second,
+		Timeout:      time.Second,
+		AllowPrivate: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// pending returns the names of the persisted deliveries in dir.
+func pending(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// waitDelivered waits until dir has no pending delivery left.
+func waitDelivered(t *testing.T, dir string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pending(t, dir)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries still pending: %v", pending(t, dir))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	r, url := newReceiver(t)
+	dir := t.TempDir()
+	d := newTestDispatcher(t, dir)
+	if err := d.Enqueue(url, map[string]string{"id": "job"}); err != nil {
+		t.Fatal(err)
+	}
+	calls := r.wait(t, 1)
+
+	c := calls[0]
+	if string(c.body) != `{"id":"job"}` {
+		t.Fatalf("body %s", c.body)
+	}
+	if want := Sign([]byte("secret"), c.body); c.signature != want {
+		t.Fatalf("signature %s, want %s", c.signature, want)
+	}
+	if c.signature == Sign([]byte("other"), c.body) || c.delivery == "" {
+		t.Fatalf("signature %s, delivery %s", c.signature, c.delivery)
+	}
+	waitDelivered(t, dir)
+}
+
+func TestRetryOnServerError(t *testing.T) {
+	r, url := newReceiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+	dir := t.TempDir()
+	d := newTestDispatcher(t, dir)
+	if err := d.Enqueue(url, "payload"); err != nil {
+		t.Fatal(err)
+	}
+	calls := r.wait(t, 3)
+	waitDelivered(t, dir)
+
+	// retries keep the delivery ID and wait longer each time
+	for _, c := range calls[1:] {
+		if c.delivery != calls[0].delivery {
+			t.Fatalf("delivery %s, want %s", c.delivery, calls[0].delivery)
+		}
+	}
+	if gap := calls[1].at.Sub(calls[0].at); gap < 20*time.Millisecond {
+		t.Fatalf("first retry after %v", gap)
+	}
+	if gap := calls[2].at.Sub(calls[1].at); gap < 40*time.Millisecond {
+		t.Fatalf("second retry after %v", gap)
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	r, url := newReceiver(t, 500, 500, 500, 500, 500)
+	dir := t.TempDir()
+	d := newTestDispatcher(t, dir)
+	if err := d.Enqueue(url, "payload"); err != nil {
+		t.Fatal(err)
+	}
+	r.wait(t, 4)
+	waitDelivered(t, dir)
+	select {
+	case <-r.received:
+		t.Fatal("delivered past MaxAttempts")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{opts: Options{BaseDelay: time.Second, MaxDelay: 5 * time.Second}}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := d.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	r, url := newReceiver(t)
+	dir := t.TempDir()
+	// a delivery left over by a previous run, after a failed attempt
+	left := &Delivery{
+		ID:          "left-over",
+		URL:         url,
+		Payload:     json.RawMessage(`{"id":"job"}`),
+		Attempts:    1,
+		NextAttempt: time.Now(),
+	}
+	data, err := json.Marshal(left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "left-over.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "corrupt.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newTestDispatcher(t, dir)
+	calls := r.wait(t, 1)
+	if c := calls[0]; c.delivery != "left-over" || c.signature != Sign([]byte("secret"), c.body) {
+		t.Fatalf("delivery %s, signature %s", c.delivery, c.signature)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		names := pending(t, dir)
+		if len(names) == 1 && filepath.Base(names[0]) == "corrupt.json" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pending deliveries %v", names)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -1,20 +1,27 @@
 package webp
 
 import (
+	"context"
+	"github.com/dunkbing/tinyimg/tinyimg/utils"
 	"image"
 	"io"
 	"log/slog"
-	"os/exec"
+	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chai2010/webp"
 )
 
 // Options represent WebP encoding options.
 type Options struct {
-	Lossless bool `json:"lossless"`
-	Quality  int  `json:"quality"`
+	Lossless bool          `json:"lossless"`
+	Quality  int           `json:"quality"`
+	Timeout  time.Duration `json:"timeout"`
+	// KeepMetadata keeps the EXIF, XMP and ICC data of the input.
+	KeepMetadata bool `json:"keepMetadata"`
 }
 
 // DecodeWebp a webp file and return an image.
@@ -30,19 +37,31 @@ func DecodeWebp(r io.Reader) (image.Image, string, error) {
 	return i, realFormat, nil
 }
 
-// Encode encodes an image into webp and returns a buffer.
-func Encode(inputFile, outDir string) (string, error) {
+// Encode compresses inputFile into a WebP in outDir. The encoder is killed
+// and the partial output removed when ctx is done or the timeout expires.
+func Encode(ctx context.Context, inputFile, outDir string, o *Options) (string, error) {
 	slog.Info("Encode WebP", "inputFile", inputFile)
+	if o.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+
 	filename := path.Base(inputFile)
 	outputFile := path.Join(outDir, filename)
 	outputFile = strings.Replace(outputFile, path.Ext(outputFile), ".webp", 1)
 
-	cmd := exec.Command(
-		"cwebp", "-q", "80",
-		inputFile, "-o", outputFile,
-	)
-	err := cmd.Run()
+	args := []string{"-q", strconv.Itoa(o.Quality)}
+	if o.Lossless {
+		args = append(args, "-lossless")
+	}
+	if o.KeepMetadata {
+		args = append(args, "-metadata", "all")
+	}
+	args = append(args, inputFile, "-o", outputFile)
+	err := utils.RunCommand(ctx, "cwebp", args...)
 	if err != nil {
+		_ = os.Remove(outputFile)
 		return "", err
 	}
 